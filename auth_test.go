@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useAdminAuth sets the admin token and localhost policy, with an empty API key store, for the
+// duration of a test
+func useAdminAuth(t *testing.T, token string, allowLocal bool) {
+	t.Helper()
+	savedToken, savedAllowLocal, savedKeys := adminToken, adminAllowLocal, apiKeys
+	t.Cleanup(func() {
+		adminTokenLock.Lock()
+		adminToken = savedToken
+		adminTokenLock.Unlock()
+		adminAllowLocal, apiKeys = savedAllowLocal, savedKeys
+	})
+
+	adminTokenLock.Lock()
+	adminToken = token
+	adminTokenLock.Unlock()
+	adminAllowLocal = allowLocal
+	apiKeys = loadAPIKeys(filepath.Join(t.TempDir(), "api-keys.json"))
+}
+
+// adminRequest builds a request as if it came through the admin socket
+func adminRequest(method, target string, body io.Reader) *http.Request {
+	r := httptest.NewRequest(method, target, body)
+	return r.WithContext(context.WithValue(r.Context(), adminConnKey{}, true))
+}
+
+// createAPIKey issues a key and returns its plaintext
+func createAPIKey(t *testing.T, apps, actions []string) string {
+	t.Helper()
+	key, _, err := apiKeys.create("test", apps, actions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// holdDeployLock makes deploys of an app return at once as already in progress. The lock is never
+// released, since a deploy goroutine may still be starting when the test ends.
+func holdDeployLock(appName string) {
+	lock, _ := deployLocks.LoadOrStore(appName, &sync.Mutex{})
+	lock.(*sync.Mutex).TryLock()
+}
+
+func TestRequireAdmin(t *testing.T) {
+	handler := requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	tests := []struct {
+		name       string
+		token      string
+		allowLocal bool
+		remoteAddr string
+		header     map[string]string
+		want       int
+	}{
+		{name: "localhost", allowLocal: true, remoteAddr: "127.0.0.1:40000", want: 200},
+		{name: "localhost IPv6", allowLocal: true, remoteAddr: "[::1]:40000", want: 200},
+		{name: "remote", allowLocal: true, remoteAddr: "203.0.113.7:40000", want: 401},
+		{name: "localhost disabled", remoteAddr: "127.0.0.1:40000", want: 401},
+		{name: "forwarded by a local proxy", allowLocal: true, remoteAddr: "127.0.0.1:40000",
+			header: map[string]string{"X-Forwarded-For": "203.0.113.7"}, want: 401},
+		{name: "real IP from a local proxy", allowLocal: true, remoteAddr: "127.0.0.1:40000",
+			header: map[string]string{"X-Real-IP": "203.0.113.7"}, want: 401},
+		{name: "remote with token", token: "admin-token", remoteAddr: "203.0.113.7:40000",
+			header: map[string]string{"Authorization": "Bearer admin-token"}, want: 200},
+		{name: "remote with wrong token", token: "admin-token", remoteAddr: "203.0.113.7:40000",
+			header: map[string]string{"Authorization": "Bearer other"}, want: 401},
+		{name: "empty token never matches", remoteAddr: "203.0.113.7:40000",
+			header: map[string]string{"Authorization": "Bearer "}, want: 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useAdminAuth(t, tt.token, tt.allowLocal)
+			r := httptest.NewRequest("POST", "/reload", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for name, value := range tt.header {
+				r.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadAdminToken(t *testing.T) {
+	useAdminAuth(t, "", false)
+	path := filepath.Join(t.TempDir(), "admin-token")
+	if err := os.WriteFile(path, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("DOCKUP_ADMIN_TOKEN", "")
+	loadAdminToken(path)
+	if adminToken != "from-file" {
+		t.Errorf("token = %q, want it read from the file", adminToken)
+	}
+
+	t.Setenv("DOCKUP_ADMIN_TOKEN", " from-env ")
+	loadAdminToken(path)
+	if adminToken != "from-env" {
+		t.Errorf("token = %q, want the environment to take precedence", adminToken)
+	}
+
+	t.Setenv("DOCKUP_ADMIN_TOKEN", "")
+	loadAdminToken(filepath.Join(t.TempDir(), "missing"))
+	if adminToken != "" {
+		t.Errorf("token = %q with no file, want none", adminToken)
+	}
+}
+
+func TestAdminSocket(t *testing.T) {
+	setupWebhookTest(t)
+	useAdminAuth(t, "", false) // Neither a token nor localhost: only the socket grants access
+
+	path := filepath.Join(t.TempDir(), "agent.sock")
+	if err := os.WriteFile(path, nil, 0600); err != nil { // Stale socket from a previous run
+		t.Fatal(err)
+	}
+	listener, err := listenAdminSocket(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0660 || info.Mode()&os.ModeSocket == 0 {
+		t.Errorf("socket mode = %v, want a 0660 socket", info.Mode())
+	}
+
+	adminMux := http.NewServeMux()
+	registerAdminRoutes(adminMux)
+	server := &http.Server{Handler: withAdminConn(adminMux)}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://localhost/deliveries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("admin socket: status %d: %s", resp.StatusCode, body)
+	}
+
+	// The same route over TCP still needs credentials
+	w := httptest.NewRecorder()
+	adminMux.ServeHTTP(w, httptest.NewRequest("GET", "/deliveries", nil))
+	if w.Code != 401 {
+		t.Errorf("over TCP: status %d, want 401", w.Code)
+	}
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	config := setupWebhookTest(t)
+	useAdminAuth(t, "", false)
+	holdDeployLock("myapp")
+	savedSecretAuth := appSecretAuth
+	t.Cleanup(func() { appSecretAuth = savedSecretAuth })
+	appSecretAuth = true
+
+	deployKey := createAPIKey(t, []string{"myapp"}, []string{actionDeploy})
+	otherAppKey := createAPIKey(t, []string{"other"}, []string{actionDeploy})
+	logsKey := createAPIKey(t, []string{"*"}, []string{actionLogs})
+	adminKey := createAPIKey(t, []string{"*"}, []string{actionAdmin})
+
+	tests := []struct {
+		name, method, target, bearer string
+		handler                      http.HandlerFunc
+		want                         int
+	}{
+		{"manual without credentials", "POST", "/webhook/manual?app=myapp", "", handleManual, 401},
+		{"manual with deploy key", "POST", "/webhook/manual?app=myapp", deployKey, handleManual, 200},
+		{"manual with another app's key", "POST", "/webhook/manual?app=myapp", otherAppKey, handleManual, 401},
+		{"manual with logs key", "POST", "/webhook/manual?app=myapp", logsKey, handleManual, 401},
+		{"manual with admin key", "POST", "/webhook/manual?app=myapp", adminKey, handleManual, 200},
+		{"manual with app secret", "POST", "/webhook/manual?app=myapp", config.Secret, handleManual, 200},
+		{"captures with logs key", "GET", "/webhooks?app=myapp", logsKey, handleWebhookCaptures, 200},
+		{"captures with deploy key", "GET", "/webhooks?app=myapp", deployKey, handleWebhookCaptures, 401},
+		{"captures with app secret", "GET", "/webhooks?app=myapp", config.Secret, handleWebhookCaptures, 401},
+		{"redelivery with logs key", "POST", "/webhooks?app=myapp&id=x", logsKey, handleWebhookCaptures, 401},
+		{"redelivery with app secret", "POST", "/webhooks?app=myapp&id=x", config.Secret, handleWebhookCaptures, 401},
+		{"redelivery with deploy key", "POST", "/webhooks?app=myapp&id=x", deployKey, handleWebhookCaptures, 404},
+		{"admin endpoint with deploy key", "GET", "/deliveries", deployKey, requireAdmin(handleDeliveries), 401},
+		{"admin endpoint with admin key", "GET", "/deliveries", adminKey, requireAdmin(handleDeliveries), 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			if tt.bearer != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+			w := httptest.NewRecorder()
+			tt.handler(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+		})
+	}
+
+	// The legacy secret can be switched off entirely
+	appSecretAuth = false
+	r := httptest.NewRequest("POST", "/webhook/manual?app=myapp", nil)
+	r.Header.Set("Authorization", "Bearer "+config.Secret)
+	w := httptest.NewRecorder()
+	handleManual(w, r)
+	if w.Code != 401 {
+		t.Errorf("app secret with -app-secret-auth=false: status %d, want 401", w.Code)
+	}
+}
+
+func TestHandleAPIKeys(t *testing.T) {
+	useAdminAuth(t, "", false)
+
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handleAPIKeys(w, adminRequest("POST", "/api-keys", strings.NewReader(body)))
+		return w
+	}
+	for _, body := range []string{
+		`{`,
+		`{"name":"ci","apps":["myapp"]}`,
+		`{"name":"ci","apps":["myapp"],"actions":["rollback"]}`,
+	} {
+		if w := post(body); w.Code != 400 {
+			t.Errorf("POST %s: status %d, want 400", body, w.Code)
+		}
+	}
+
+	w := post(`{"name":"ci","apps":["myapp"],"actions":["deploy"]}`)
+	if w.Code != 201 {
+		t.Fatalf("create: status %d: %s", w.Code, w.Body.String())
+	}
+	var created struct {
+		APIKey
+		Key string `json:"key"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(created.Key, "dku_") || created.Hash != "" {
+		t.Errorf("created key %q with hash %q", created.Key, created.Hash)
+	}
+
+	// Only the hash is stored
+	data, err := os.ReadFile(apiKeys.path)
+	if err != nil || strings.Contains(string(data), created.Key) || !strings.Contains(string(data), hashAPIKey(created.Key)) {
+		t.Errorf("key file = %s, %v", data, err)
+	}
+
+	if _, ok := apiKeys.authorize(created.Key, "myapp", actionDeploy); !ok {
+		t.Fatal("new key not accepted")
+	}
+	w = httptest.NewRecorder()
+	handleAPIKeys(w, adminRequest("GET", "/api-keys", nil))
+	var listed []APIKey
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || listed[0].Hash != "" || listed[0].LastUsedAt == nil {
+		t.Errorf("listed keys = %+v, want one without its hash and with a last-used time", listed)
+	}
+
+	w = httptest.NewRecorder()
+	handleAPIKeys(w, adminRequest("DELETE", "/api-keys?id="+created.ID, nil))
+	if w.Code != 200 {
+		t.Fatalf("revoke: status %d", w.Code)
+	}
+	if _, ok := loadAPIKeys(apiKeys.path).authorize(created.Key, "myapp", actionDeploy); ok {
+		t.Error("revoked key still accepted after a restart")
+	}
+	w = httptest.NewRecorder()
+	handleAPIKeys(w, adminRequest("DELETE", "/api-keys?id="+created.ID, nil))
+	if w.Code != 404 {
+		t.Errorf("revoking twice: status %d, want 404", w.Code)
+	}
+}
+
+// useAuditLog enables the audit log for the duration of a test and returns its path
+func useAuditLog(t *testing.T, chain bool) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	al, err := openAuditLog(path, chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := auditor
+	auditor = al
+	t.Cleanup(func() {
+		auditor = saved
+		al.file.Close()
+	})
+	return path
+}
+
+// readAuditLog parses every entry of an audit log
+func readAuditLog(t *testing.T, path string) []auditEntry {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []auditEntry
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var entry auditEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("bad audit line %q: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestAuditLogHashChain(t *testing.T) {
+	path := useAuditLog(t, true)
+	audit(auditEntry{Action: "config.reload", Actor: "admin-socket", Outcome: "success"})
+	audit(auditEntry{Action: "deploy.trigger", App: "myapp", Actor: "github", Outcome: "accepted"})
+
+	// Reopening picks the chain up where it left off
+	reopened, err := openAuditLog(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.file.Close()
+	if err := reopened.write(auditEntry{Time: time.Now().UTC(), Action: "apikey.revoke", Actor: "localhost", Outcome: "success"}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := readAuditLog(t, path)
+	if len(entries) != 3 {
+		t.Fatalf("got %d entries, want 3", len(entries))
+	}
+	prev := ""
+	for i, entry := range entries {
+		if entry.Time.IsZero() || entry.PrevHash != prev {
+			t.Errorf("entry %d: time %v, prev_hash %q, want %q", i, entry.Time, entry.PrevHash, prev)
+		}
+		hash := entry.Hash
+		entry.Hash = ""
+		unhashed, _ := json.Marshal(entry)
+		sum := sha256.Sum256(unhashed)
+		if hash != hex.EncodeToString(sum[:]) {
+			t.Errorf("entry %d: hash %q doesn't match its content", i, hash)
+		}
+		prev = hash
+	}
+}
+
+func TestAuditedRequests(t *testing.T) {
+	setupWebhookTest(t)
+	useAdminAuth(t, "", false)
+	holdDeployLock("myapp")
+	path := useAuditLog(t, false)
+	deployKey := createAPIKey(t, []string{"myapp"}, []string{actionDeploy})
+	keyID := apiKeys.list()[0].ID
+
+	manual := func(bearer string) {
+		r := httptest.NewRequest("POST", "/webhook/manual?app=myapp", nil)
+		r.RemoteAddr = "203.0.113.7:40000"
+		r.Header.Set("Authorization", "Bearer "+bearer)
+		handleManual(httptest.NewRecorder(), r)
+	}
+	manual("wrong")
+	manual(deployKey)
+	requireAdmin(handleDeliveries)(httptest.NewRecorder(), httptest.NewRequest("GET", "/deliveries", nil))
+	w := httptest.NewRecorder()
+	requireAdmin(handleAPIKeys)(w, adminRequest("DELETE", "/api-keys?id="+keyID, nil))
+
+	entries := readAuditLog(t, path)
+	want := []auditEntry{
+		{Action: "deploy.trigger", App: "myapp", Actor: "anonymous", SourceIP: "203.0.113.7", Outcome: "denied"},
+		{Action: "deploy.trigger", App: "myapp", Actor: "api-key:" + keyID, SourceIP: "203.0.113.7", Outcome: "accepted"},
+		{Action: "admin.denied", Actor: "anonymous", SourceIP: "192.0.2.1", Outcome: "denied"},
+		{Action: "apikey.revoke", Actor: "admin-socket", SourceIP: "unix", Outcome: "success"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d entries, want %d: %+v", len(entries), len(want), entries)
+	}
+	for i, entry := range entries {
+		got := auditEntry{Action: entry.Action, App: entry.App, Actor: entry.Actor, SourceIP: entry.SourceIP, Outcome: entry.Outcome}
+		if fmt.Sprint(got) != fmt.Sprint(want[i]) {
+			t.Errorf("entry %d = %+v, want %+v", i, got, want[i])
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// initGitRepo creates an empty git repository and returns its path
+func initGitRepo(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	if out, err := exec.Command("git", "init", "-q", dir).CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v\n%s", err, out)
+	}
+	return dir
+}
+
+// fakeCommandScript stands in for git and docker: it logs its arguments, fails when they contain
+// $FAKE_FAIL, prints $FAKE_OUTPUT/<command>-<subcommand> when that file exists, and fakes just
+// enough of clone and config for deploys to run
+const fakeCommandScript = `#!/bin/sh
+echo "$(basename "$0") $*" >> "$FAKE_LOG"
+if [ -n "$FAKE_FAIL" ]; then
+	case " $* " in *" $FAKE_FAIL "*) echo "fake failure: $FAKE_FAIL"; exit 1;; esac
+fi
+output="$FAKE_OUTPUT/$(basename "$0")-$1"
+if [ -f "$output" ]; then
+	cat "$output"
+	exit 0
+fi
+case "$(basename "$0") $1" in
+"git clone") for last; do :; done; mkdir -p "$last" && touch "$last/docker-compose.yml";;
+"git config") echo "https://github.com/owner/repo.git";;
+esac
+`
+
+// useFakeCommands puts fake git and docker commands first in PATH, with empty managed env and
+// deploy result stores and an empty Docker engine, and returns the path of the log they write
+// their arguments to
+func useFakeCommands(t *testing.T) string {
+	t.Helper()
+	bin := t.TempDir()
+	for _, name := range []string{"git", "docker"} {
+		if err := os.WriteFile(filepath.Join(bin, name), []byte(fakeCommandScript), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	logPath := filepath.Join(t.TempDir(), "commands.log")
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("FAKE_LOG", logPath)
+	t.Setenv("FAKE_FAIL", "")
+	t.Setenv("FAKE_OUTPUT", t.TempDir())
+
+	savedEnv, savedDeploys, savedDocker := appEnv, lastDeploys, docker
+	appEnv = newAppEnvStore(t.TempDir())
+	lastDeploys = loadDeployResults(filepath.Join(t.TempDir(), "deploys.json"))
+	docker = &fakeDockerEngine{}
+	t.Cleanup(func() { appEnv, lastDeploys, docker = savedEnv, savedDeploys, savedDocker })
+	return logPath
+}
+
+// fakeCommandOutput sets what a fake command prints for a subcommand, e.g. "docker", "ps"
+func fakeCommandOutput(t *testing.T, command, subcommand, output string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(os.Getenv("FAKE_OUTPUT"), command+"-"+subcommand), []byte(output), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fakeCommandLog returns the commands run so far, one per line
+func fakeCommandLog(t *testing.T, logPath string) string {
+	t.Helper()
+	data, err := os.ReadFile(logPath)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestGitAuthEnv(t *testing.T) {
+	dir := initGitRepo(t)
+	configBefore, err := os.ReadFile(filepath.Join(dir, ".git", "config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := func(url string) string {
+		cmd := exec.Command("git", "config", "--get-urlmatch", "http.extraHeader", url)
+		cmd.Dir = dir
+		cmd.Env = append(gitSafeEnviron(), gitAuthEnv("ghs_token123")...)
+		out, _ := cmd.Output()
+		return strings.TrimSpace(string(out))
+	}
+
+	want := "Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte("x-access-token:ghs_token123"))
+	if got := header("https://github.com/org/repo.git"); got != want {
+		t.Errorf("github.com header = %q, want %q", got, want)
+	}
+	if got := header("https://example.com/org/repo.git"); got != "" {
+		t.Errorf("token sent to another host: %q", got)
+	}
+
+	configAfter, _ := os.ReadFile(filepath.Join(dir, ".git", "config"))
+	if string(configAfter) != string(configBefore) {
+		t.Error(".git/config modified")
+	}
+}
+
+func TestGitSafeEnviron(t *testing.T) {
+	t.Setenv("GIT_TRACE_CURL", "1")
+	t.Setenv("GIT_CURL_VERBOSE", "1")
+	t.Setenv("GIT_CONFIG_COUNT", "1")
+	t.Setenv("DOCKUP_TEST_KEEP", "1")
+
+	env := strings.Join(gitSafeEnviron(), "\n")
+	for _, name := range []string{"GIT_TRACE_CURL=", "GIT_CURL_VERBOSE=", "GIT_CONFIG_COUNT="} {
+		if strings.Contains(env, name) {
+			t.Errorf("%s passed to git", name)
+		}
+	}
+	if !strings.Contains(env, "DOCKUP_TEST_KEEP=1") {
+		t.Error("unrelated variable dropped")
+	}
+}
+
+func TestRunDeploySteps(t *testing.T) {
+	dir := initGitRepo(t)
+	steps := []deployStep{
+		{args: []string{"git", "config", "--get-urlmatch", "http.extraHeader", "https://github.com/org/repo"}, env: gitAuthEnv("tok")},
+		{args: []string{"git", "no-such-command"}},
+		{args: []string{"git", "config", "user.name", "should-not-run"}},
+	}
+
+	output, err := runDeploySteps(dir, steps)
+	if err == nil || !strings.Contains(err.Error(), "git no-such-command") {
+		t.Fatalf("err = %v, want the failing step", err)
+	}
+	if !strings.Contains(string(output), "Authorization: Basic") {
+		t.Errorf("step environment not applied: %s", output)
+	}
+	if out, _ := exec.Command("git", "-C", dir, "config", "user.name").Output(); strings.TrimSpace(string(out)) == "should-not-run" {
+		t.Error("steps after a failure ran")
+	}
+}
+
+func TestAppLifecycle(t *testing.T) {
+	useAdminAuth(t, "", false)
+	config := setupWebhookTest(t)
+	os.WriteFile(filepath.Join(config.Path, "docker-compose.yml"), nil, 0600)
+	registryLock.Lock()
+	registry = map[string]AppConfig{"shop": config} // Other tests leave myapp's deploy lock held
+	registryLock.Unlock()
+	path := writeTestRegistry(t, "{}")
+	useRegistryPath(t, path)
+	auditPath := useAuditLog(t, false)
+	commandLog := useFakeCommands(t)
+
+	post := func(target, key string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := adminRequest("POST", target, nil)
+		if key != "" {
+			r = httptest.NewRequest("POST", target, nil)
+			r.Header.Set("Authorization", "Bearer "+key)
+		}
+		w := httptest.NewRecorder()
+		handleApps(w, r)
+		return w
+	}
+	lastCommand := func() string {
+		lines := strings.Split(strings.TrimSpace(fakeCommandLog(t, commandLog)), "\n")
+		return lines[len(lines)-1]
+	}
+	stopped := func() bool {
+		data, _ := os.ReadFile(path)
+		return appStopped("shop") && strings.Contains(string(data), `"stopped": true`)
+	}
+
+	// Stop persists the flag, and everything that would bring the app back up respects it
+	if w := post("/apps/shop/stop", ""); w.Code != 200 || !strings.HasSuffix(lastCommand(), "down") || !stopped() {
+		t.Fatalf("stop: status %d, body %q, command %q", w.Code, w.Body.String(), lastCommand())
+	}
+	for _, target := range []string{"/apps/shop/restart", "/apps/shop/scale?service=web&replicas=2"} {
+		if w := post(target, ""); w.Code != 409 {
+			t.Errorf("%s while stopped: status %d", target, w.Code)
+		}
+	}
+	if err := runDeploy("shop", config, "manual"); !errors.Is(err, errAppStopped) {
+		t.Errorf("runDeploy while stopped = %v", err)
+	}
+	w := httptest.NewRecorder()
+	handleGithub(w, githubRequest(`{"ref":"refs/heads/main","repository":{"name":"shop"}}`, "d1", config.Secret))
+	if history := deliveries.list("shop", 1); w.Code != 200 || len(history) != 1 || history[0].Outcome != "app_stopped" {
+		t.Errorf("push while stopped: status %d, deliveries %+v", w.Code, history)
+	}
+	w = httptest.NewRecorder()
+	handleApps(w, adminRequest("PATCH", "/apps/shop", strings.NewReader(`{"branch": "main"}`)))
+	if w.Code != 200 || !stopped() {
+		t.Errorf("PATCH cleared the stopped flag: status %d", w.Code)
+	}
+
+	if w := post("/apps/shop/start", ""); w.Code != 200 || !strings.HasSuffix(lastCommand(), "up -d --remove-orphans") || appStopped("shop") {
+		t.Fatalf("start: status %d, body %q, command %q", w.Code, w.Body.String(), lastCommand())
+	}
+	if w := post("/apps/shop/restart?service=web", ""); w.Code != 200 || !strings.HasSuffix(lastCommand(), "restart web") {
+		t.Errorf("restart: status %d, command %q", w.Code, lastCommand())
+	}
+	if w := post("/apps/shop/scale?service=worker&replicas=3", ""); w.Code != 200 || !strings.HasSuffix(lastCommand(), "--scale worker=3 worker") {
+		t.Errorf("scale: status %d, command %q", w.Code, lastCommand())
+	}
+
+	// API keys need the lifecycle action
+	lifecycleKey := createAPIKey(t, []string{"shop"}, []string{actionLifecycle})
+	deployKey := createAPIKey(t, []string{"shop"}, []string{actionDeploy})
+	if w := post("/apps/shop/restart", lifecycleKey); w.Code != 200 || !strings.HasSuffix(lastCommand(), " restart") {
+		t.Errorf("lifecycle key: status %d, command %q", w.Code, lastCommand())
+	}
+	if w := post("/apps/shop/stop", deployKey); w.Code != 401 || appStopped("shop") {
+		t.Errorf("deploy key: status %d", w.Code)
+	}
+
+	for target, want := range map[string]int{
+		"/apps/shop/scale?service=web":             400,
+		"/apps/shop/scale?replicas=2":              400,
+		"/apps/shop/scale?service=web&replicas=-1": 400,
+		"/apps/shop/stop?service=web":              400,
+		"/apps/shop/explode":                       404,
+		"/apps/shop/stop/now":                      404,
+		"/apps/missing/stop":                       404,
+	} {
+		if w := post(target, ""); w.Code != want {
+			t.Errorf("%s: status %d, want %d", target, w.Code, want)
+		}
+	}
+	w = httptest.NewRecorder()
+	handleApps(w, adminRequest("GET", "/apps/shop/stop", nil))
+	if w.Code != 405 {
+		t.Errorf("GET stop: status %d", w.Code)
+	}
+
+	// A failed command is reported, and a failed stop leaves the app marked stopped
+	t.Setenv("FAKE_FAIL", "down")
+	if w := post("/apps/shop/stop", ""); w.Code != 500 || !strings.Contains(w.Body.String(), "stays marked stopped") || !stopped() {
+		t.Errorf("failed stop: status %d, body %q", w.Code, w.Body.String())
+	}
+
+	var outcomes []string
+	for _, entry := range readAuditLog(t, auditPath) {
+		if strings.HasPrefix(entry.Action, "app.") && entry.Action != "app.update" {
+			outcomes = append(outcomes, entry.Action+":"+entry.Outcome)
+		}
+	}
+	want := "app.stop:success app.start:success app.restart:success app.scale:success app.restart:success app.stop:denied app.stop:failure"
+	if strings.Join(outcomes, " ") != want {
+		t.Errorf("audit = %v\nwant %s", outcomes, want)
+	}
+}
+
+func TestAppLifecycleDuringDeploy(t *testing.T) {
+	useAdminAuth(t, "", false)
+	setupWebhookTest(t)
+	useFakeCommands(t)
+	registryLock.Lock()
+	registry["busy-shop"] = AppConfig{Path: t.TempDir(), Branch: "main", Secret: "s"}
+	registryLock.Unlock()
+
+	holdDeployLock("busy-shop")
+	w := httptest.NewRecorder()
+	handleApps(w, adminRequest("POST", "/apps/busy-shop/restart", nil))
+	if w.Code != 409 {
+		t.Errorf("restart during a deploy: status %d", w.Code)
+	}
+}
+
+func TestRunDeployRecordsResult(t *testing.T) {
+	useFakeCommands(t)
+	config := AppConfig{Path: t.TempDir(), Branch: "main", Secret: "s"}
+	fakeCommandOutput(t, "git", "rev-parse", "0123abcd\n")
+
+	if err := runDeploy("recorded", config, "manual"); err != nil {
+		t.Fatal(err)
+	}
+	if result, ok := lastDeploys.get("recorded"); !ok || result.Status != jobSucceeded || result.SHA != "0123abcd" || result.Type != "manual" {
+		t.Errorf("result = %+v, %v", result, ok)
+	}
+
+	t.Setenv("FAKE_FAIL", "build")
+	if err := runDeploy("recorded", config, "github"); err == nil {
+		t.Fatal("deploy succeeded")
+	}
+	if result, _ := lastDeploys.get("recorded"); result.Status != jobFailed || result.Error == "" || result.Type != "github" {
+		t.Errorf("result = %+v", result)
+	}
+
+	// Results survive a restart
+	if result, ok := loadDeployResults(lastDeploys.path).get("recorded"); !ok || result.Status != jobFailed {
+		t.Errorf("reloaded result = %+v, %v", result, ok)
+	}
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeDockerEngine is an in-memory dockerEngine: containers and volumes are matched against
+// label filters like the daemon does, and logs are served from canned raw streams
+type fakeDockerEngine struct {
+	containers map[string]dockerContainer // By full ID
+	images     map[string]dockerImage     // By ID or reference
+	volumes    []dockerVolume
+	logs       map[string][]byte // Raw log stream per container ID
+	err        error             // Returned by every call when set
+
+	logOptions     map[string]dockerLogsOptions // Options of the last ContainerLogs call per ID
+	removedVolumes []string
+}
+
+func (f *fakeDockerEngine) ListContainers(ctx context.Context, filters map[string][]string) ([]dockerContainerSummary, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	var summaries []dockerContainerSummary
+	for id, c := range f.containers {
+		if matchesLabelFilters(c.Config.Labels, filters) {
+			summaries = append(summaries, dockerContainerSummary{ID: id, Names: []string{c.Name}, Labels: c.Config.Labels})
+		}
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].ID < summaries[j].ID })
+	return summaries, nil
+}
+
+func (f *fakeDockerEngine) InspectContainer(ctx context.Context, id string) (dockerContainer, error) {
+	if f.err != nil {
+		return dockerContainer{}, f.err
+	}
+	c, ok := f.containers[id]
+	if !ok {
+		return dockerContainer{}, &dockerError{StatusCode: 404, Message: "No such container: " + id}
+	}
+	return c, nil
+}
+
+func (f *fakeDockerEngine) ContainerLogs(ctx context.Context, id string, opts dockerLogsOptions) (io.ReadCloser, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	// Like the daemon, accept a unique ID prefix
+	for fullID, stream := range f.logs {
+		if strings.HasPrefix(fullID, id) {
+			if f.logOptions == nil {
+				f.logOptions = make(map[string]dockerLogsOptions)
+			}
+			f.logOptions[fullID] = opts
+			return io.NopCloser(bytes.NewReader(stream)), nil
+		}
+	}
+	return nil, &dockerError{StatusCode: 404, Message: "No such container: " + id}
+}
+
+func (f *fakeDockerEngine) Events(ctx context.Context, filters map[string][]string, handle func(dockerEvent)) error {
+	if f.err != nil {
+		return f.err
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (f *fakeDockerEngine) InspectImage(ctx context.Context, ref string) (dockerImage, error) {
+	if f.err != nil {
+		return dockerImage{}, f.err
+	}
+	image, ok := f.images[ref]
+	if !ok {
+		return dockerImage{}, &dockerError{StatusCode: 404, Message: "No such image: " + ref}
+	}
+	return image, nil
+}
+
+func (f *fakeDockerEngine) ListVolumes(ctx context.Context, filters map[string][]string) ([]dockerVolume, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	var volumes []dockerVolume
+	for _, v := range f.volumes {
+		if matchesLabelFilters(v.Labels, filters) {
+			volumes = append(volumes, v)
+		}
+	}
+	return volumes, nil
+}
+
+func (f *fakeDockerEngine) RemoveVolume(ctx context.Context, name string) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.removedVolumes = append(f.removedVolumes, name)
+	return nil
+}
+
+func (f *fakeDockerEngine) Prune(ctx context.Context) (uint64, error) {
+	return 0, f.err
+}
+
+// matchesLabelFilters applies "label" filters of the form key=value
+func matchesLabelFilters(labels map[string]string, filters map[string][]string) bool {
+	for _, filter := range filters["label"] {
+		key, value, _ := strings.Cut(filter, "=")
+		if labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// muxFrame encodes one frame of a multiplexed log stream
+func muxFrame(stream byte, payload string) []byte {
+	header := make([]byte, 8)
+	header[0] = stream
+	binary.BigEndian.PutUint32(header[4:], uint32(len(payload)))
+	return append(header, payload...)
+}
+
+// testContainer builds an inspected compose container of service in the project at dir
+func testContainer(id, dir, service string) dockerContainer {
+	var c dockerContainer
+	c.ID = id
+	c.Name = "/app-" + service + "-1"
+	c.Image = "sha256:" + service
+	c.State.Status = "running"
+	c.State.StartedAt = time.Now().Add(-time.Hour)
+	c.Config.Image = service + ":latest"
+	c.Config.Labels = map[string]string{
+		"com.docker.compose.project":             "app",
+		"com.docker.compose.service":             service,
+		"com.docker.compose.project.working_dir": dir,
+	}
+	return c
+}
+
+// setupDockerTest registers an app named myapp backed by engine and restores the globals afterwards
+func setupDockerTest(t *testing.T, engine *fakeDockerEngine) AppConfig {
+	t.Helper()
+	dir := t.TempDir()
+	config := AppConfig{Path: dir, Branch: "main", Secret: "test-secret"}
+
+	savedRegistry, savedDocker, savedDeploys, savedKeys := registry, docker, lastDeploys, apiKeys
+	t.Cleanup(func() {
+		registryLock.Lock()
+		registry = savedRegistry
+		registryLock.Unlock()
+		docker, lastDeploys, apiKeys = savedDocker, savedDeploys, savedKeys
+	})
+
+	registryLock.Lock()
+	registry = map[string]AppConfig{"myapp": config}
+	registryLock.Unlock()
+	docker = engine
+	lastDeploys = loadDeployResults(filepath.Join(t.TempDir(), "deploys.json"))
+	apiKeys = loadAPIKeys(filepath.Join(t.TempDir(), "api-keys.json"))
+	return config
+}
+
+func TestDemuxDockerStream(t *testing.T) {
+	tests := []struct {
+		name       string
+		stream     []byte
+		wantStdout string
+		wantStderr string
+		wantErr    bool
+	}{
+		{name: "empty"},
+		{
+			name:       "both streams",
+			stream:     bytes.Join([][]byte{muxFrame(1, "out 1\n"), muxFrame(2, "err 1\n"), muxFrame(1, "out 2\n")}, nil),
+			wantStdout: "out 1\nout 2\n",
+			wantStderr: "err 1\n",
+		},
+		{
+			name:       "line split across frames",
+			stream:     append(muxFrame(1, "par"), muxFrame(1, "tial\n")...),
+			wantStdout: "partial\n",
+		},
+		{
+			name:       "empty frame",
+			stream:     append(muxFrame(2, ""), muxFrame(2, "x\n")...),
+			wantStderr: "x\n",
+		},
+		{name: "truncated header", stream: []byte{1, 0, 0}, wantErr: true},
+		{name: "truncated payload", stream: muxFrame(1, "hello")[:10], wantErr: true},
+		{name: "unknown stream", stream: muxFrame(7, "x"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			err := demuxDockerStream(bytes.NewReader(tt.stream), &stdout, &stderr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if stdout.String() != tt.wantStdout || stderr.String() != tt.wantStderr {
+				t.Errorf("stdout %q, stderr %q; want %q, %q", stdout.String(), stderr.String(), tt.wantStdout, tt.wantStderr)
+			}
+		})
+	}
+}
+
+func TestHandleAppStatus(t *testing.T) {
+	engine := &fakeDockerEngine{}
+	config := setupDockerTest(t, engine)
+
+	web := testContainer(strings.Repeat("a", 64), config.Path, "web")
+	web.RestartCount = 2
+	web.State.Health = &struct {
+		Status string `json:"Status"`
+	}{Status: "healthy"}
+	worker := testContainer(strings.Repeat("b", 64), config.Path, "worker")
+	worker.State.Status = "exited"
+	worker.State.ExitCode = 1
+	other := testContainer(strings.Repeat("c", 64), "/srv/other", "web")
+	engine.containers = map[string]dockerContainer{web.ID: web, worker.ID: worker, other.ID: other}
+	engine.images = map[string]dockerImage{"sha256:web": {ID: "sha256:web", RepoDigests: []string{"web@sha256:1234"}}}
+	engine.volumes = []dockerVolume{
+		{Name: "app_data", Labels: map[string]string{"com.docker.compose.project": "app"}},
+		{Name: "other_data", Labels: map[string]string{"com.docker.compose.project": "other"}},
+	}
+
+	w := httptest.NewRecorder()
+	handleAppStatus(w, adminRequest("GET", "/apps/myapp", nil), "myapp")
+	if w.Code != 200 {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	var status struct {
+		Name        string            `json:"name"`
+		Containers  []containerStatus `json:"containers"`
+		Volumes     []string          `json:"volumes"`
+		DockerError string            `json:"docker_error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Name != "myapp" || status.DockerError != "" {
+		t.Errorf("name %q, docker_error %q", status.Name, status.DockerError)
+	}
+	if len(status.Containers) != 2 {
+		t.Fatalf("got %d containers, want the app's 2: %+v", len(status.Containers), status.Containers)
+	}
+	got := status.Containers[0]
+	if got.ID != strings.Repeat("a", 12) || got.Service != "web" || got.Name != "app-web-1" || got.State != "running" ||
+		got.Health != "healthy" || got.RestartCount != 2 || got.ImageDigest != "web@sha256:1234" || got.Uptime == "" {
+		t.Errorf("web container = %+v", got)
+	}
+	got = status.Containers[1]
+	if got.Service != "worker" || got.State != "exited" || got.ExitCode != 1 || got.ImageDigest != "" || got.Uptime != "" {
+		t.Errorf("worker container = %+v", got)
+	}
+	if len(status.Volumes) != 1 || status.Volumes[0] != "app_data" {
+		t.Errorf("volumes = %v, want [app_data]", status.Volumes)
+	}
+}
+
+func TestHandleAppStatusErrors(t *testing.T) {
+	engine := &fakeDockerEngine{}
+	setupDockerTest(t, engine)
+
+	w := httptest.NewRecorder()
+	handleAppStatus(w, httptest.NewRequest("GET", "/apps/myapp", nil), "myapp")
+	if w.Code != 401 {
+		t.Errorf("unauthenticated: status %d, want 401", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handleAppStatus(w, adminRequest("GET", "/apps/nope", nil), "nope")
+	if w.Code != 404 {
+		t.Errorf("unknown app: status %d, want 404", w.Code)
+	}
+
+	// Docker being down is reported in the status, not as a failed request
+	engine.err = fmt.Errorf("%w: dial unix /var/run/docker.sock: connect: no such file or directory", errDockerUnavailable)
+	w = httptest.NewRecorder()
+	handleAppStatus(w, adminRequest("GET", "/apps/myapp", nil), "myapp")
+	if w.Code != 200 {
+		t.Fatalf("docker down: status %d, want 200", w.Code)
+	}
+	var status appStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(status.DockerError, "docker daemon unavailable") || status.Containers == nil || len(status.Containers) != 0 {
+		t.Errorf("docker_error %q, containers %v", status.DockerError, status.Containers)
+	}
+}
+
+// decodeLogLines parses an NDJSON logs response
+func decodeLogLines(t *testing.T, body string) []logLine {
+	t.Helper()
+	var lines []logLine
+	decoder := json.NewDecoder(strings.NewReader(body))
+	for {
+		var line logLine
+		if err := decoder.Decode(&line); err == io.EOF {
+			return lines
+		} else if err != nil {
+			t.Fatalf("bad NDJSON %q: %v", body, err)
+		}
+		lines = append(lines, line)
+	}
+}
+
+func TestHandleAppLogs(t *testing.T) {
+	engine := &fakeDockerEngine{}
+	config := setupDockerTest(t, engine)
+	redactor.set("app:myapp", []string{config.Secret}, 4)
+	t.Cleanup(func() { redactor.set("app:myapp", nil, 0) })
+
+	web := testContainer(strings.Repeat("a", 64), config.Path, "web")
+	console := testContainer(strings.Repeat("b", 64), config.Path, "console")
+	console.Config.Tty = true
+	engine.containers = map[string]dockerContainer{web.ID: web, console.ID: console}
+	engine.logs = map[string][]byte{
+		web.ID: bytes.Join([][]byte{
+			muxFrame(1, "2026-01-02T03:04:05.000000000Z listening\n"),
+			muxFrame(2, "2026-01-02T03:04:06.000000000Z leaked test-secret\n"),
+		}, nil),
+		console.ID: []byte("2026-01-02T03:04:07.000000000Z raw tty line\r\n"),
+	}
+
+	t.Run("all streams", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handleAppLogs(w, adminRequest("GET", "/apps/myapp/logs?service=web&timestamps=true&tail=5&since=10m", nil), "myapp")
+		if w.Code != 200 || w.Header().Get("Content-Type") != "application/x-ndjson" {
+			t.Fatalf("status %d, content type %q: %s", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+		}
+		lines := decodeLogLines(t, w.Body.String())
+		sort.Slice(lines, func(i, j int) bool { return lines[i].Stream > lines[j].Stream }) // stdout first
+		want := []logLine{
+			{Service: "web", Container: "app-web-1", Stream: "stdout", Time: "2026-01-02T03:04:05.000000000Z", Line: "listening"},
+			{Service: "web", Container: "app-web-1", Stream: "stderr", Time: "2026-01-02T03:04:06.000000000Z", Line: "leaked " + redactedPlaceholder},
+		}
+		if fmt.Sprint(lines) != fmt.Sprint(want) {
+			t.Errorf("lines = %+v\nwant %+v", lines, want)
+		}
+		opts := engine.logOptions[web.ID]
+		if opts.Tail != "5" || !opts.Timestamps || opts.Follow {
+			t.Errorf("log options = %+v", opts)
+		}
+		if age := time.Now().Unix() - opts.Since; age < 590 || age > 610 {
+			t.Errorf("since = %d, want about 10 minutes ago", opts.Since)
+		}
+	})
+
+	t.Run("stream filter", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handleAppLogs(w, adminRequest("GET", "/apps/myapp/logs?service=web&stream=stderr", nil), "myapp")
+		lines := decodeLogLines(t, w.Body.String())
+		if len(lines) != 1 || lines[0].Stream != "stderr" || lines[0].Time != "" {
+			t.Errorf("lines = %+v, want the stderr line without a time", lines)
+		}
+	})
+
+	t.Run("tty", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handleAppLogs(w, adminRequest("GET", "/apps/myapp/logs?service=console&timestamps=true", nil), "myapp")
+		lines := decodeLogLines(t, w.Body.String())
+		if len(lines) != 1 || lines[0].Stream != "stdout" || lines[0].Line != "raw tty line" {
+			t.Errorf("lines = %+v, want the raw stream as stdout", lines)
+		}
+	})
+
+	t.Run("server-sent events", func(t *testing.T) {
+		r := adminRequest("GET", "/apps/myapp/logs?service=console", nil)
+		r.Header.Set("Accept", "text/event-stream")
+		w := httptest.NewRecorder()
+		handleAppLogs(w, r, "myapp")
+		if w.Header().Get("Content-Type") != "text/event-stream" || !strings.HasPrefix(w.Body.String(), "event: stdout\ndata: {") {
+			t.Errorf("content type %q, body %q", w.Header().Get("Content-Type"), w.Body.String())
+		}
+	})
+}
+
+func TestHandleAppLogsErrors(t *testing.T) {
+	engine := &fakeDockerEngine{}
+	config := setupDockerTest(t, engine)
+	web := testContainer(strings.Repeat("a", 64), config.Path, "web")
+	engine.containers = map[string]dockerContainer{web.ID: web}
+	engine.logs = map[string][]byte{web.ID: nil}
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		admin  bool
+		err    error
+		want   int
+	}{
+		{name: "unauthenticated", method: "GET", target: "/apps/myapp/logs", want: 401},
+		{name: "method", method: "POST", target: "/apps/myapp/logs", admin: true, want: 405},
+		{name: "tail", method: "GET", target: "/apps/myapp/logs?tail=-1", admin: true, want: 400},
+		{name: "since", method: "GET", target: "/apps/myapp/logs?since=yesterday", admin: true, want: 400},
+		{name: "stream", method: "GET", target: "/apps/myapp/logs?stream=stdin", admin: true, want: 400},
+		{name: "unknown service", method: "GET", target: "/apps/myapp/logs?service=db", admin: true, want: 404},
+		{name: "docker down", method: "GET", target: "/apps/myapp/logs", admin: true, err: fmt.Errorf("%w: connection refused", errDockerUnavailable), want: 503},
+		{name: "docker error", method: "GET", target: "/apps/myapp/logs", admin: true, err: &dockerError{StatusCode: 500, Message: "boom"}, want: 500},
+		{name: "empty logs", method: "GET", target: "/apps/myapp/logs", admin: true, want: 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine.err = tt.err
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			if tt.admin {
+				r = adminRequest(tt.method, tt.target, nil)
+			}
+			w := httptest.NewRecorder()
+			handleAppLogs(w, r, "myapp")
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestDockerClientErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/" + dockerAPIVersion + "/containers/json":
+			var filters map[string][]string
+			if err := json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters); err != nil || r.URL.Query().Get("all") != "1" {
+				http.Error(w, "bad filters", 400)
+				return
+			}
+			json.NewEncoder(w).Encode([]dockerContainerSummary{{ID: "abc", Labels: map[string]string{"label": filters["label"][0]}}})
+		case "/" + dockerAPIVersion + "/images/ghcr.io/org/app:1/json":
+			w.WriteHeader(404)
+			w.Write([]byte(`{"message":"No such image: ghcr.io/org/app:1"}`))
+		default:
+			w.WriteHeader(500)
+			w.Write([]byte("plain failure"))
+		}
+	}))
+	defer server.Close()
+
+	// The client only speaks to a Unix socket, so point its transport at the test server instead
+	dc := newDockerClient("/nonexistent.sock")
+	dc.client = &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "tcp", server.Listener.Addr().String())
+		},
+	}}
+	ctx := context.Background()
+
+	containers, err := dc.ListContainers(ctx, map[string][]string{"label": {"a=b"}})
+	if err != nil || len(containers) != 1 || containers[0].Labels["label"] != "a=b" {
+		t.Errorf("ListContainers = %+v, %v", containers, err)
+	}
+
+	_, err = dc.InspectImage(ctx, "ghcr.io/org/app:1")
+	if !isDockerNotFound(err) || !strings.Contains(err.Error(), "No such image") {
+		t.Errorf("InspectImage err = %v, want a not found dockerError", err)
+	}
+
+	_, err = dc.InspectContainer(ctx, "abc")
+	var de *dockerError
+	if !errors.As(err, &de) || de.StatusCode != 500 || de.Message != "plain failure" || isDockerNotFound(err) {
+		t.Errorf("InspectContainer err = %#v", err)
+	}
+
+	_, err = newDockerClient("unix://"+filepath.Join(t.TempDir(), "missing.sock")).ListContainers(ctx, nil)
+	if !errors.Is(err, errDockerUnavailable) || strings.Contains(err.Error(), "http://docker") {
+		t.Errorf("missing socket err = %v, want errDockerUnavailable without the URL", err)
+	}
+}
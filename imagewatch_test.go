@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseImageRef(t *testing.T) {
+	tests := []struct {
+		image   string
+		want    imageRef
+		wantErr bool
+	}{
+		{image: "nginx", want: imageRef{Registry: "registry-1.docker.io", Repository: "library/nginx", Tag: "latest"}},
+		{image: "nginx:1.25-alpine", want: imageRef{Registry: "registry-1.docker.io", Repository: "library/nginx", Tag: "1.25-alpine"}},
+		{image: "grafana/grafana:10.0.0", want: imageRef{Registry: "registry-1.docker.io", Repository: "grafana/grafana", Tag: "10.0.0"}},
+		{image: "ghcr.io/org/app:v1", want: imageRef{Registry: "ghcr.io", Repository: "org/app", Tag: "v1"}},
+		{image: "ghcr.io/org/team/app", want: imageRef{Registry: "ghcr.io", Repository: "org/team/app", Tag: "latest"}},
+		{image: "localhost/app", want: imageRef{Registry: "localhost", Repository: "app", Tag: "latest"}},
+		{image: "localhost:5000/app:dev", want: imageRef{Registry: "localhost:5000", Repository: "app", Tag: "dev"}},
+		{image: "registry:5000/team/app", want: imageRef{Registry: "registry:5000", Repository: "team/app", Tag: "latest"}},
+		{image: "nginx@sha256:0123", wantErr: true},
+		{image: "ghcr.io/", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseImageRef(tt.image)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseImageRef(%q) err = %v, want error %v", tt.image, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		tt.want.Original = tt.image
+		if got != tt.want {
+			t.Errorf("parseImageRef(%q) = %+v, want %+v", tt.image, got, tt.want)
+		}
+	}
+}
+
+func TestInMaintenanceWindow(t *testing.T) {
+	at := func(hhmm string) time.Time {
+		parsed, err := time.Parse("15:04", hhmm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return time.Date(2026, 1, 2, parsed.Hour(), parsed.Minute(), 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		window, now string
+		want        bool
+	}{
+		{"02:00-04:00", "02:00", true},
+		{"02:00-04:00", "03:59", true},
+		{"02:00-04:00", "04:00", false},
+		{"02:00-04:00", "01:59", false},
+		{"23:00-02:00", "23:30", true},
+		{"23:00-02:00", "01:00", true},
+		{"23:00-02:00", "12:00", false},
+		{" 02:00 - 04:00 ", "03:00", true},
+	}
+	for _, tt := range tests {
+		got, err := inMaintenanceWindow(tt.window, at(tt.now))
+		if err != nil || got != tt.want {
+			t.Errorf("inMaintenanceWindow(%q) at %s = %v, %v; want %v", tt.window, tt.now, got, err, tt.want)
+		}
+	}
+
+	for _, window := range []string{"", "02:00", "02:00-04:00-06:00", "2am-4am", "02:00-25:00"} {
+		if _, err := inMaintenanceWindow(window, at("03:00")); err == nil {
+			t.Errorf("inMaintenanceWindow(%q) accepted an invalid window", window)
+		}
+	}
+}
+
+func TestImageWatchDue(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 0, 0, 0, time.UTC)
+	t.Cleanup(func() { imageWatchChecks.Delete("watched") })
+
+	if !imageWatchDue("watched", &ImageWatchConfig{}, now) {
+		t.Error("never-checked app not due")
+	}
+	if imageWatchDue("watched", &ImageWatchConfig{Interval: "1s"}, now) {
+		t.Error("interval below the tick accepted")
+	}
+	if imageWatchDue("watched", &ImageWatchConfig{MaintenanceWindow: "04:00-05:00"}, now) {
+		t.Error("due outside the maintenance window")
+	}
+
+	imageWatchChecks.Store("watched", now.Add(-time.Hour))
+	if imageWatchDue("watched", &ImageWatchConfig{Interval: "2h"}, now) {
+		t.Error("due before the interval elapsed")
+	}
+	if !imageWatchDue("watched", &ImageWatchConfig{Interval: "30m"}, now) {
+		t.Error("not due after the interval elapsed")
+	}
+}
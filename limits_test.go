@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useLimits installs request limits for a test and restores the previous ones afterwards
+func useLimits(t *testing.T, ipPerMin int, bodyBytes int64) {
+	t.Helper()
+	savedLimiter, savedMax := ipLimiter, maxBodyBytes
+	t.Cleanup(func() { ipLimiter, maxBodyBytes = savedLimiter, savedMax })
+	ipLimiter, maxBodyBytes = newRateLimiter(ipPerMin), bodyBytes
+}
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(3)
+	for i := 0; i < 3; i++ {
+		if !rl.allow("a") {
+			t.Fatalf("request %d denied within the burst", i+1)
+		}
+	}
+	if rl.allow("a") {
+		t.Error("request allowed past the burst")
+	}
+	if !rl.exhausted("a") {
+		t.Error("exhausted(a) = false after using the burst")
+	}
+	if rl.exhausted("b") || !rl.allow("b") {
+		t.Error("keys are not limited independently")
+	}
+
+	// Refill is continuous: a bucket last used a minute ago is full again
+	rl.buckets["a"].last = rl.buckets["a"].last.Add(-time.Minute)
+	if rl.exhausted("a") || !rl.allow("a") {
+		t.Error("bucket did not refill")
+	}
+
+	for _, disabled := range []*rateLimiter{newRateLimiter(0), nil} {
+		for i := 0; i < 100; i++ {
+			if !disabled.allow("a") || disabled.exhausted("a") {
+				t.Fatal("disabled limiter limited a request")
+			}
+		}
+	}
+}
+
+func TestLimitPublicRequests(t *testing.T) {
+	useLimits(t, 2, 16)
+	handler := limitPublicRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			http.Error(w, "Request body too large", 413)
+		}
+	}))
+
+	send := func(path, remoteAddr, body string) int {
+		r := httptest.NewRequest("POST", path, strings.NewReader(body))
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := send("/webhook/manual", "203.0.113.1:1000", strings.Repeat("x", 17)); code != 413 {
+		t.Errorf("oversized body: status %d, want 413", code)
+	}
+	if code := send("/webhook/manual", "203.0.113.1:1001", "{}"); code != 200 {
+		t.Errorf("second request: status %d, want 200", code)
+	}
+	if code := send("/webhook/manual", "203.0.113.1:1002", "{}"); code != 429 {
+		t.Errorf("request past the IP budget: status %d, want 429", code)
+	}
+	if code := send("/webhook/manual", "203.0.113.2:1000", "{}"); code != 200 {
+		t.Errorf("other IP: status %d, want 200", code)
+	}
+
+	// GitHub's shared IPs are budgeted by handleGithub instead
+	if code := send("/webhook/github", "203.0.113.1:1003", "{}"); code != 200 {
+		t.Errorf("GitHub webhook: status %d, want 200", code)
+	}
+}
+
+func TestHandleGithubIPBudget(t *testing.T) {
+	config := setupWebhookTest(t)
+	useLimits(t, 2, 0)
+	push := `{"ref":"refs/heads/other","repository":{"name":"myapp"}}`
+
+	post := func(r *http.Request) int {
+		r.RemoteAddr = "192.0.2.10:4000"
+		w := httptest.NewRecorder()
+		handleGithub(w, r)
+		return w.Code
+	}
+
+	// Valid signed deliveries don't use up the shared IP's budget
+	for i := 0; i < 5; i++ {
+		if code := post(githubRequest(push, fmt.Sprintf("ok-%d", i), config.Secret)); code != 200 {
+			t.Fatalf("signed delivery %d: status %d, want 200", i+1, code)
+		}
+	}
+
+	// Rejected and replayed requests count against it
+	deliveries.accept("d1", []byte(push))
+	if code := post(githubRequest(push, "d1", config.Secret)); code != 409 {
+		t.Fatalf("replayed delivery: status %d, want 409", code)
+	}
+	if code := post(githubRequest(push, "forged", "wrong-secret")); code != 403 {
+		t.Fatalf("forged delivery: status %d, want 403", code)
+	}
+	if code := post(githubRequest(push, "ok-last", config.Secret)); code != 429 {
+		t.Errorf("delivery after the budget was used up: status %d, want 429", code)
+	}
+}
+
+func TestParseCIDRList(t *testing.T) {
+	nets, err := parseCIDRList(" 192.30.252.0/22, ,203.0.113.7,2001:db8::1 ")
+	if err != nil || len(nets) != 3 {
+		t.Fatalf("parseCIDRList = %v, %v", nets, err)
+	}
+	for _, ip := range []string{"192.30.255.1", "203.0.113.7", "2001:db8::1"} {
+		if !ipInNets(net.ParseIP(ip), nets) {
+			t.Errorf("%s not in %v", ip, nets)
+		}
+	}
+	for _, ip := range []string{"192.30.248.1", "203.0.113.8", "2001:db8::2"} {
+		if ipInNets(net.ParseIP(ip), nets) {
+			t.Errorf("%s unexpectedly in %v", ip, nets)
+		}
+	}
+	if _, err := parseCIDRList("10.0.0.0/8,not-a-cidr"); err == nil {
+		t.Error("invalid entry accepted")
+	}
+}
+
+func TestPublicClientIP(t *testing.T) {
+	saved := trustedProxies
+	t.Cleanup(func() { trustedProxies = saved })
+	trustedProxies, _ = parseCIDRList("10.0.0.0/8")
+
+	tests := []struct {
+		remoteAddr, forwarded, want string
+	}{
+		{"203.0.113.5:1234", "", "203.0.113.5"},
+		{"203.0.113.5:1234", "198.51.100.1", "203.0.113.5"}, // Untrusted peers can't spoof
+		{"10.0.0.2:1234", "", "10.0.0.2"},
+		{"10.0.0.2:1234", "198.51.100.1", "198.51.100.1"},
+		{"10.0.0.2:1234", "6.6.6.6, 198.51.100.1, 10.0.0.3", "198.51.100.1"}, // Rightmost untrusted hop
+		{"10.0.0.2:1234", "garbage, 10.0.0.3", "10.0.0.2"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/webhook/github", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if tt.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		if got := publicClientIP(r); got != tt.want {
+			t.Errorf("publicClientIP(%s, XFF %q) = %s, want %s", tt.remoteAddr, tt.forwarded, got, tt.want)
+		}
+	}
+}
+
+func TestRestrictToGitHub(t *testing.T) {
+	savedHooks, savedProxies := githubHooks, trustedProxies
+	t.Cleanup(func() { githubHooks, trustedProxies = savedHooks, savedProxies })
+	useAuditLog(t, false)
+	githubHooks = loadGitHubHookRanges(filepath.Join(t.TempDir(), "github-meta.json"))
+	trustedProxies, _ = parseCIDRList("10.0.0.1")
+
+	handler := restrictToGitHub(func(w http.ResponseWriter, r *http.Request) {})
+	send := func(remoteAddr, forwarded string) int {
+		r := httptest.NewRequest("POST", "/webhook/github", nil)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("X-Forwarded-For", forwarded)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+
+	if code := send("192.30.252.10:443", ""); code != 200 {
+		t.Errorf("GitHub address: status %d, want 200", code)
+	}
+	if code := send("203.0.113.5:443", "192.30.252.10"); code != 403 {
+		t.Errorf("spoofed X-Forwarded-For: status %d, want 403", code)
+	}
+	if code := send("10.0.0.1:443", "192.30.252.10"); code != 200 {
+		t.Errorf("GitHub address behind a trusted proxy: status %d, want 200", code)
+	}
+}
+
+func TestLoadGitHubHookRanges(t *testing.T) {
+	cachePath := filepath.Join(t.TempDir(), "github-meta.json")
+	if err := os.WriteFile(cachePath, []byte(`{"hooks":["198.51.100.0/24"],"fetched_at":"2026-01-02T03:04:05Z"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ranges := loadGitHubHookRanges(cachePath)
+	if !ranges.contains(net.ParseIP("198.51.100.9")) || ranges.contains(net.ParseIP("192.30.252.10")) {
+		t.Errorf("cached ranges not used: %v", ranges.nets)
+	}
+
+	if err := os.WriteFile(cachePath, []byte(`{"hooks":["bogus"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ranges = loadGitHubHookRanges(cachePath)
+	if !ranges.contains(net.ParseIP("192.30.252.10")) || !ranges.fetchedAt.IsZero() {
+		t.Error("invalid cache didn't fall back to the static ranges")
+	}
+}
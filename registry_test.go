@@ -0,0 +1,818 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestRegistry writes a registry.json for a test and returns its path
+func writeTestRegistry(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "registry.json")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// useRegistry restores the registry and app secret redaction after a test
+func useRegistry(t *testing.T) {
+	t.Helper()
+	registryLock.RLock()
+	saved := registry
+	registryLock.RUnlock()
+	t.Cleanup(func() {
+		registryLock.Lock()
+		registry = saved
+		registryLock.Unlock()
+		redactor.clearPrefix("app:")
+		redactor.clearPrefix("env:")
+	})
+}
+
+// useRegistryPath points reloads at path for the duration of a test
+func useRegistryPath(t *testing.T, path string) {
+	t.Helper()
+	useRegistry(t)
+	saved := registryPath
+	registryPath = path
+	t.Cleanup(func() { registryPath = saved })
+}
+
+func TestValidBranchName(t *testing.T) {
+	valid := []string{"main", "feature/login", "release-1.2", "user/jane/fix_bug", "v2", "a.b"}
+	invalid := []string{
+		"", "@", "-main", "/main", "main/", "main.", "a..b", "a//b", "a@{1}", ".hidden", "feature/.hidden",
+		"main.lock", "feature/x.lock", "has space", "a~1", "a^", "a:b", "a?", "a*", "a[b", `a\b`, "tab\tname", "del\x7f",
+	}
+	for _, name := range valid {
+		if !validBranchName(name) {
+			t.Errorf("validBranchName(%q) = false, want true", name)
+		}
+	}
+	for _, name := range invalid {
+		if validBranchName(name) {
+			t.Errorf("validBranchName(%q) = true, want false", name)
+		}
+	}
+}
+
+func TestParseRegistry(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	os.WriteFile(file, nil, 0600)
+
+	registryPath := writeTestRegistry(t, `{
+		"good": {"path": "`+dir+`", "branch": "main", "secret": "s1"},
+		"typo": {"path": "`+dir+`", "branch": "main", "secret": "s2", "brnach": "dev"},
+		"later": {"path": "`+filepath.Join(dir, "not-cloned")+`", "branch": "main", "secret": "s3"},
+		"bad": {"path": "relative", "branch": "a..b", "secret": ""},
+		"notdir": {"path": "`+file+`", "branch": "main", "secret": "s4"},
+		"bad name!": {"path": "`+dir+`", "branch": "main", "secret": "s5"},
+		"wrongtype": {"path": 42}
+	}`)
+
+	apps, warnings, err := parseRegistry(registryPath)
+	var loadErr *registryLoadError
+	if !errors.As(err, &loadErr) {
+		t.Fatalf("err = %v, want a *registryLoadError", err)
+	}
+
+	invalid := make(map[string]int)
+	for _, re := range loadErr.Errors {
+		invalid[re.App]++
+	}
+	if len(invalid) != 4 || invalid["bad"] != 3 || invalid["notdir"] != 1 || invalid["bad name!"] != 1 || invalid["wrongtype"] != 1 {
+		t.Errorf("errors = %v", loadErr.Errors)
+	}
+	if len(apps) != 3 || apps["good"].Secret != "s1" || apps["typo"].Branch != "main" || apps["later"].Secret != "s3" {
+		t.Errorf("valid apps = %v", apps)
+	}
+
+	got := make(map[string]string)
+	for _, warning := range warnings {
+		got[warning.App] = warning.Message
+	}
+	if len(got) != 2 || !strings.Contains(got["typo"], `unknown field "brnach"`) || !strings.Contains(got["later"], "does not exist") {
+		t.Errorf("warnings = %v", warnings)
+	}
+
+	for content, want := range map[string]string{"": "file is empty", "{": "invalid JSON", `{} {}`: "unexpected data"} {
+		apps, _, err := parseRegistry(writeTestRegistry(t, content))
+		if apps != nil || err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("registry %q: apps %v, err %v; want %q", content, apps, err, want)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	useRegistry(t)
+	dir := t.TempDir()
+	valid := `{"myapp": {"path": "` + dir + `", "branch": "main", "secret": "secret-one"}}`
+	mixed := `{"myapp": {"path": "` + dir + `", "branch": "main", "secret": "secret-two"}, "broken": {"path": "` + dir + `"}}`
+
+	if _, err := loadConfig(writeTestRegistry(t, valid), false); err != nil {
+		t.Fatal(err)
+	}
+
+	// A reload with any invalid app keeps the current registry
+	if _, err := loadConfig(writeTestRegistry(t, mixed), false); err == nil {
+		t.Fatal("invalid registry loaded")
+	}
+	registryLock.RLock()
+	current := registry["myapp"].Secret
+	registryLock.RUnlock()
+	if current != "secret-one" {
+		t.Errorf("registry replaced by an invalid reload (secret %q)", current)
+	}
+
+	// At startup the valid apps run and the invalid ones are reported
+	warnings, err := loadConfig(writeTestRegistry(t, mixed), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registryLock.RLock()
+	_, broken := registry["broken"]
+	current = registry["myapp"].Secret
+	registryLock.RUnlock()
+	if broken || current != "secret-two" {
+		t.Errorf("startup load: broken app loaded %v, myapp secret %q", broken, current)
+	}
+	if len(warnings) == 0 || warnings[0].App != "broken" || !strings.HasPrefix(warnings[0].Message, "skipped: ") {
+		t.Errorf("warnings = %v", warnings)
+	}
+	if got := redact("secret-two"); got != redactedPlaceholder {
+		t.Errorf("app secret not registered for redaction: %q", got)
+	}
+
+	// File-level errors are fatal even at startup
+	if _, err := loadConfig(writeTestRegistry(t, "{"), true); err == nil {
+		t.Error("malformed registry accepted at startup")
+	}
+}
+
+func TestValidateAppConfig(t *testing.T) {
+	config := AppConfig{Path: filepath.Join(t.TempDir(), "missing"), Branch: "main", Secret: "s"}
+	if problems := validateAppConfig(config); len(problems) != 1 || !strings.Contains(problems[0], "does not exist") {
+		t.Errorf("problems = %v, want the missing path", problems)
+	}
+	config.Path = filepath.Dir(config.Path)
+	if problems := validateAppConfig(config); len(problems) != 0 {
+		t.Errorf("problems = %v", problems)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestRegistry(t, `{"myapp": {"path": "`+dir+`", "branch": "main", "secret": "secret-one"}}`)
+	useRegistryPath(t, path)
+	auditPath := useAuditLog(t, false)
+
+	result := reloadConfig("api", "admin", "127.0.0.1")
+	if !result.Success || result.Apps != 1 || result.Trigger != "api" || result.Error != "" {
+		t.Fatalf("reload = %+v", result)
+	}
+
+	// Warnings don't fail a reload
+	os.WriteFile(path, []byte(`{
+		"myapp": {"path": "`+dir+`", "branch": "main", "secret": "secret-one"},
+		"later": {"path": "`+filepath.Join(dir, "not-cloned")+`", "branch": "main", "secret": "secret-two"}
+	}`), 0600)
+	result = reloadConfig("file", "system", "")
+	if !result.Success || result.Apps != 2 || len(result.Warnings) != 1 || result.Warnings[0].App != "later" {
+		t.Errorf("reload with warnings = %+v", result)
+	}
+
+	// An invalid app fails the reload and keeps the current registry
+	os.WriteFile(path, []byte(`{"myapp": {"path": "`+dir+`", "branch": "a..b", "secret": "secret-three"}}`), 0600)
+	result = reloadConfig("sighup", "system", "")
+	if result.Success || len(result.Errors) != 1 || result.Errors[0].App != "myapp" || result.Apps != 2 {
+		t.Errorf("invalid reload = %+v", result)
+	}
+	registryLock.RLock()
+	current := registry["myapp"].Secret
+	registryLock.RUnlock()
+	if current != "secret-one" {
+		t.Errorf("registry replaced by an invalid reload (secret %q)", current)
+	}
+	if last := lastReloadResult(); last.Trigger != "sighup" || last.Success {
+		t.Errorf("last reload = %+v", last)
+	}
+
+	entries := readAuditLog(t, auditPath)
+	if len(entries) != 3 || entries[0].Action != "config.reload" || entries[0].Actor != "admin" ||
+		entries[0].Outcome != "success" || entries[2].Outcome != "failure" {
+		t.Errorf("audit entries = %+v", entries)
+	}
+}
+
+func TestHandleReload(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestRegistry(t, `{
+		"myapp": {"path": "`+dir+`", "branch": "main", "secret": "secret-one"},
+		"later": {"path": "`+filepath.Join(dir, "not-cloned")+`", "branch": "main", "secret": "secret-two"}
+	}`)
+	useRegistryPath(t, path)
+
+	w := httptest.NewRecorder()
+	handleReload(w, adminRequest("POST", "/reload", nil))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "Now watching 2 apps") || !strings.Contains(w.Body.String(), "Warning: app later: ") {
+		t.Errorf("POST /reload: status %d, body %q", w.Code, w.Body.String())
+	}
+
+	os.WriteFile(path, []byte(`{"myapp": {"path": "relative", "branch": "main", "secret": "secret-one"}}`), 0600)
+	w = httptest.NewRecorder()
+	handleReload(w, adminRequest("POST", "/reload", nil))
+	if w.Code != 422 || !strings.Contains(w.Body.String(), "current registry kept") {
+		t.Errorf("invalid registry: status %d, body %q", w.Code, w.Body.String())
+	}
+
+	os.Remove(path)
+	w = httptest.NewRecorder()
+	handleReload(w, adminRequest("POST", "/reload", nil))
+	if w.Code != 500 {
+		t.Errorf("missing registry: status %d, body %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	handleReload(w, adminRequest("GET", "/reload", nil))
+	var last reloadResult
+	if err := json.NewDecoder(w.Body).Decode(&last); err != nil || last.Trigger != "api" || last.Success || last.Apps != 2 {
+		t.Errorf("GET /reload = %+v, %v", last, err)
+	}
+
+	w = httptest.NewRecorder()
+	handleReload(w, adminRequest("DELETE", "/reload", nil))
+	if w.Code != 405 {
+		t.Errorf("DELETE /reload: status %d", w.Code)
+	}
+}
+
+func TestWatchConfigFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "registry.json")
+	os.WriteFile(path, []byte(`{}`), 0600)
+
+	events := make(chan string, 10)
+	notify := func(trigger string) {
+		select {
+		case events <- trigger:
+		default:
+		}
+	}
+	if err := watchConfigFiles([]string{path, filepath.Join(dir, "github-app.json")}, notify); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := func(what string, want bool) {
+		t.Helper()
+		select {
+		case trigger := <-events:
+			if !want {
+				t.Errorf("%s: unexpected %q notification", what, trigger)
+			} else if trigger != "file" {
+				t.Errorf("%s: trigger %q", what, trigger)
+			}
+		case <-time.After(500 * time.Millisecond):
+			if want {
+				t.Errorf("%s: no notification", what)
+			}
+		}
+		for len(events) > 0 {
+			<-events
+		}
+	}
+
+	// Files next to the config aren't watched
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("x"), 0600)
+	expect("unrelated file", false)
+
+	os.WriteFile(path, []byte(`{"a": {}}`), 0600)
+	expect("write", true)
+
+	// Atomic replacement, as with "jq ... > tmp && mv tmp registry.json"
+	tmp := filepath.Join(dir, "registry.json.tmp")
+	os.WriteFile(tmp, []byte(`{}`), 0600)
+	os.Rename(tmp, path)
+	expect("rename", true)
+
+	os.WriteFile(filepath.Join(dir, "github-app.json"), []byte(`{}`), 0600)
+	expect("new file", true)
+
+	if err := watchConfigFiles([]string{filepath.Join(dir, "missing", "registry.json")}, notify); err == nil {
+		t.Error("watching a missing directory succeeded")
+	}
+}
+
+func TestHandleApps(t *testing.T) {
+	useAdminAuth(t, "", false)
+	path := writeTestRegistry(t, `{}`)
+	useRegistryPath(t, path)
+	auditPath := useAuditLog(t, false)
+	dir := t.TempDir()
+
+	send := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handleApps(w, r)
+		return w
+	}
+	body := func(s string) io.Reader { return strings.NewReader(s) }
+	saved := func() map[string]AppConfig {
+		t.Helper()
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var apps map[string]AppConfig
+		if err := json.Unmarshal(data, &apps); err != nil {
+			t.Fatal(err)
+		}
+		return apps
+	}
+
+	// Creating without a secret generates one and returns it once
+	w := send(adminRequest("POST", "/apps/myapp", body(`{"path": "`+dir+`", "branch": "main"}`)))
+	var created struct {
+		App    appView `json:"app"`
+		Secret string  `json:"secret"`
+	}
+	if w.Code != 201 || json.NewDecoder(w.Body).Decode(&created) != nil || len(created.Secret) != 64 || created.App.Branch != "main" {
+		t.Fatalf("POST: status %d, %+v", w.Code, created)
+	}
+	if apps := saved(); apps["myapp"].Secret != created.Secret {
+		t.Errorf("saved registry = %+v", apps)
+	}
+	registryLock.RLock()
+	live := registry["myapp"]
+	registryLock.RUnlock()
+	if live.Path != dir || live.Secret != created.Secret {
+		t.Errorf("registry not applied: %+v", live)
+	}
+
+	if w := send(adminRequest("POST", "/apps/myapp", body(`{"path": "`+dir+`", "branch": "main"}`))); w.Code != 409 {
+		t.Errorf("creating twice: status %d", w.Code)
+	}
+
+	// PATCH changes only the fields given and keeps the secret; the previous file is backed up
+	w = send(adminRequest("PATCH", "/apps/myapp", body(`{"branch": "release", "env": {"MODE": "prod"}}`)))
+	if w.Code != 200 || strings.Contains(w.Body.String(), created.Secret) {
+		t.Errorf("PATCH: status %d, body %q", w.Code, w.Body.String())
+	}
+	if app := saved()["myapp"]; app.Branch != "release" || app.Path != dir || app.Secret != created.Secret || app.Env["MODE"] != "prod" {
+		t.Errorf("after PATCH: %+v", app)
+	}
+	if backup, err := os.ReadFile(path + ".bak"); err != nil || !strings.Contains(string(backup), `"main"`) {
+		t.Errorf("backup = %q, %v", backup, err)
+	}
+
+	// PUT replaces the entry; a given secret is kept as is
+	w = send(adminRequest("PUT", "/apps/other", body(`{"path": "`+dir+`", "branch": "main", "secret": "given-secret"}`)))
+	if w.Code != 201 || strings.Contains(w.Body.String(), "given-secret") || saved()["other"].Secret != "given-secret" {
+		t.Errorf("PUT: status %d, body %q", w.Code, w.Body.String())
+	}
+
+	// Invalid changes are rejected and leave the file alone
+	before, _ := os.ReadFile(path)
+	for name, r := range map[string]*http.Request{
+		"invalid branch":  adminRequest("PATCH", "/apps/myapp", body(`{"branch": "a..b"}`)),
+		"missing path":    adminRequest("PUT", "/apps/myapp", body(`{"path": "`+filepath.Join(dir, "missing")+`", "branch": "main"}`)),
+		"unknown field":   adminRequest("PATCH", "/apps/myapp", body(`{"brnach": "dev"}`)),
+		"invalid name":    adminRequest("PUT", "/apps/bad%20name", body(`{}`)),
+		"nested path":     adminRequest("PUT", "/apps/a/b", body(`{}`)),
+		"unknown app":     adminRequest("PATCH", "/apps/nope", body(`{"branch": "main"}`)),
+		"unknown method":  adminRequest("OPTIONS", "/apps/myapp", nil),
+		"unauthenticated": httptest.NewRequest("DELETE", "/apps/myapp", nil),
+	} {
+		w := send(r)
+		if w.Code < 400 {
+			t.Errorf("%s: status %d", name, w.Code)
+		}
+	}
+	if after, _ := os.ReadFile(path); string(after) != string(before) {
+		t.Errorf("rejected changes modified the registry:\n%s", after)
+	}
+
+	// API keys need admin scope for the app
+	deployKey := createAPIKey(t, []string{"myapp"}, []string{actionDeploy})
+	adminKey := createAPIKey(t, []string{"myapp"}, []string{actionAdmin})
+	r := httptest.NewRequest("DELETE", "/apps/myapp", nil)
+	r.Header.Set("Authorization", "Bearer "+deployKey)
+	if w := send(r); w.Code != 401 {
+		t.Errorf("deploy-scoped key: status %d", w.Code)
+	}
+	r = httptest.NewRequest("DELETE", "/apps/other", nil)
+	r.Header.Set("Authorization", "Bearer "+adminKey)
+	if w := send(r); w.Code != 401 {
+		t.Errorf("key scoped to another app: status %d", w.Code)
+	}
+	r = httptest.NewRequest("DELETE", "/apps/myapp", nil)
+	r.Header.Set("Authorization", "Bearer "+adminKey)
+	if w := send(r); w.Code != 204 {
+		t.Errorf("DELETE: status %d", w.Code)
+	}
+	if _, ok := saved()["myapp"]; ok {
+		t.Error("deleted app still in registry.json")
+	}
+	if w := send(adminRequest("DELETE", "/apps/myapp", nil)); w.Code != 404 {
+		t.Errorf("deleting twice: status %d", w.Code)
+	}
+
+	var actions []string
+	for _, entry := range readAuditLog(t, auditPath) {
+		if strings.HasPrefix(entry.Action, "app.") {
+			actions = append(actions, entry.Action+" "+entry.App)
+		}
+	}
+	if want := "app.create myapp,app.update myapp,app.create other,app.delete myapp"; strings.Join(actions, ",") != want {
+		t.Errorf("audit = %v, want %s", actions, want)
+	}
+}
+
+func TestHandleAppsEncryptsSecrets(t *testing.T) {
+	useAdminAuth(t, "", false)
+	useSecretsKey(t, "root-key-one")
+	path := writeTestRegistry(t, `{}`)
+	useRegistryPath(t, path)
+
+	w := httptest.NewRecorder()
+	handleApps(w, adminRequest("PUT", "/apps/myapp", strings.NewReader(`{"path": "`+t.TempDir()+`", "branch": "main", "secret": "plain-secret"}`)))
+	if w.Code != 201 {
+		t.Fatalf("PUT: status %d, body %q", w.Code, w.Body.String())
+	}
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), "plain-secret") || !strings.Contains(string(data), encryptedSecretPrefix) {
+		t.Errorf("registry.json = %s", data)
+	}
+	registryLock.RLock()
+	secret := registry["myapp"].Secret
+	registryLock.RUnlock()
+	if secret != "plain-secret" {
+		t.Errorf("in-memory secret = %q", secret)
+	}
+}
+
+// useAppsDir points provisioning at a temporary apps directory with no GitHub App configured
+func useAppsDir(t *testing.T) string {
+	t.Helper()
+	githubAppLock.Lock()
+	savedApp := githubAppConfig
+	githubAppConfig = nil
+	githubAppLock.Unlock()
+	savedDir := appsDir
+	appsDir = t.TempDir()
+	t.Cleanup(func() {
+		githubAppLock.Lock()
+		githubAppConfig = savedApp
+		githubAppLock.Unlock()
+		appsDir = savedDir
+	})
+	return appsDir
+}
+
+// waitForJob polls a job until it is no longer running
+func waitForJob(t *testing.T, id string) job {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		j, ok := jobs.get(id)
+		if !ok {
+			t.Fatalf("job %s not found", id)
+		}
+		if j.Status != jobRunning {
+			return j
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s still running: %+v", id, j)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// stepStatuses summarizes a job's steps as "name:status" pairs
+func stepStatuses(j job) string {
+	var parts []string
+	for _, st := range j.Steps {
+		parts = append(parts, st.Name+":"+st.Status)
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestProvisionApp(t *testing.T) {
+	useAdminAuth(t, "", false)
+	useRegistryPath(t, writeTestRegistry(t, `{}`))
+	dir := useAppsDir(t)
+	commandLog := useFakeCommands(t)
+
+	w := httptest.NewRecorder()
+	handleAppsRoot(w, adminRequest("POST", "/apps", strings.NewReader(`{"repo": "owner/my-app", "webhook_url": "https://deploy.example.com/webhook/github"}`)))
+	var accepted struct {
+		Job, App, Secret string
+	}
+	if w.Code != 202 || json.NewDecoder(w.Body).Decode(&accepted) != nil || accepted.App != "my-app" || len(accepted.Secret) != 64 {
+		t.Fatalf("POST /apps: status %d, %+v", w.Code, accepted)
+	}
+	if w.Header().Get("Location") != "/jobs/"+accepted.Job {
+		t.Errorf("Location = %q", w.Header().Get("Location"))
+	}
+
+	j := waitForJob(t, accepted.Job)
+	if j.Status != jobSucceeded || stepStatuses(j) != "clone:succeeded register:succeeded webhook:skipped deploy:succeeded" {
+		t.Fatalf("job = %s, %s (%s)", j.Status, stepStatuses(j), j.Error)
+	}
+
+	appPath := filepath.Join(dir, "my-app")
+	registryLock.RLock()
+	config, exists := registry["my-app"]
+	registryLock.RUnlock()
+	if !exists || config.Path != appPath || config.Branch != "main" || config.Secret != accepted.Secret {
+		t.Errorf("registered app = %+v", config)
+	}
+	commands := fakeCommandLog(t, commandLog)
+	for _, want := range []string{
+		"git clone --branch main -- https://github.com/owner/my-app.git " + appPath,
+		"git reset --hard origin/main",
+		"docker compose",
+	} {
+		if !strings.Contains(commands, want) {
+			t.Errorf("%q not run:\n%s", want, commands)
+		}
+	}
+
+	// The app and its checkout now exist
+	w = httptest.NewRecorder()
+	handleAppsRoot(w, adminRequest("POST", "/apps", strings.NewReader(`{"repo": "https://github.com/owner/my-app"}`)))
+	if w.Code != 409 {
+		t.Errorf("provisioning twice: status %d", w.Code)
+	}
+	registryLock.Lock()
+	delete(registry, "my-app")
+	registryLock.Unlock()
+	w = httptest.NewRecorder()
+	handleAppsRoot(w, adminRequest("POST", "/apps", strings.NewReader(`{"repo": "owner/my-app"}`)))
+	if w.Code != 409 || !strings.Contains(w.Body.String(), appPath) {
+		t.Errorf("existing checkout: status %d, body %q", w.Code, w.Body.String())
+	}
+}
+
+func TestProvisionAppFailures(t *testing.T) {
+	useAdminAuth(t, "", false)
+	path := writeTestRegistry(t, `{}`)
+	useRegistryPath(t, path)
+	dir := useAppsDir(t)
+	useFakeCommands(t)
+
+	for name, tt := range map[string]struct {
+		r    *http.Request
+		want int
+	}{
+		"missing repo":    {adminRequest("POST", "/apps", strings.NewReader(`{}`)), 400},
+		"not GitHub":      {adminRequest("POST", "/apps", strings.NewReader(`{"repo": "https://gitlab.com/owner/app"}`)), 400},
+		"invalid name":    {adminRequest("POST", "/apps", strings.NewReader(`{"repo": "owner/app", "name": "bad name"}`)), 400},
+		"invalid branch":  {adminRequest("POST", "/apps", strings.NewReader(`{"repo": "owner/app", "branch": "a..b"}`)), 400},
+		"unknown field":   {adminRequest("POST", "/apps", strings.NewReader(`{"repo": "owner/app", "brnach": "dev"}`)), 400},
+		"unauthenticated": {httptest.NewRequest("POST", "/apps", strings.NewReader(`{"repo": "owner/app"}`)), 401},
+		"wrong method":    {adminRequest("PUT", "/apps", nil), 405},
+	} {
+		w := httptest.NewRecorder()
+		handleAppsRoot(w, tt.r)
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d (%q)", name, w.Code, tt.want, w.Body.String())
+		}
+	}
+
+	// A failed clone is cleaned up and nothing is registered
+	t.Setenv("FAKE_FAIL", "clone")
+	w := httptest.NewRecorder()
+	handleAppsRoot(w, adminRequest("POST", "/apps", strings.NewReader(`{"repo": "owner/app"}`)))
+	var accepted struct{ Job string }
+	if w.Code != 202 || json.NewDecoder(w.Body).Decode(&accepted) != nil {
+		t.Fatalf("POST /apps: status %d", w.Code)
+	}
+	j := waitForJob(t, accepted.Job)
+	if j.Status != jobFailed || stepStatuses(j) != "clone:failed register:pending webhook:pending deploy:pending" ||
+		!strings.Contains(j.Steps[0].Detail, "fake failure") {
+		t.Errorf("job = %s, %s: %+v", j.Status, stepStatuses(j), j.Steps[0])
+	}
+	if _, err := os.Stat(filepath.Join(dir, "app")); !os.IsNotExist(err) {
+		t.Errorf("checkout left behind: %v", err)
+	}
+	registryLock.RLock()
+	_, exists := registry["app"]
+	registryLock.RUnlock()
+	if data, _ := os.ReadFile(path); exists || string(data) != "{}" {
+		t.Errorf("failed provisioning registered the app: %s", data)
+	}
+
+	// A failed first deploy leaves the app registered, so it can be fixed and redeployed
+	t.Setenv("FAKE_FAIL", "up")
+	w = httptest.NewRecorder()
+	handleAppsRoot(w, adminRequest("POST", "/apps", strings.NewReader(`{"repo": "owner/app"}`)))
+	json.NewDecoder(w.Body).Decode(&accepted)
+	j = waitForJob(t, accepted.Job)
+	if j.Status != jobFailed || stepStatuses(j) != "clone:succeeded register:succeeded webhook:skipped deploy:failed" {
+		t.Errorf("job = %s, %s", j.Status, stepStatuses(j))
+	}
+	registryLock.RLock()
+	_, exists = registry["app"]
+	registryLock.RUnlock()
+	if !exists {
+		t.Error("app not registered after a failed first deploy")
+	}
+}
+
+func TestHandleJobs(t *testing.T) {
+	useAdminAuth(t, "", false)
+	id := jobs.create("provision", "myapp", "clone")
+	jobs.step(id, "clone", jobSucceeded, "token ghp_"+strings.Repeat("a", 36))
+	jobs.finish(id, nil)
+
+	get := func(target, key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", target, nil)
+		if key == "admin" {
+			r = adminRequest("GET", target, nil)
+		} else if key != "" {
+			r.Header.Set("Authorization", "Bearer "+key)
+		}
+		w := httptest.NewRecorder()
+		handleJobs(w, r)
+		return w
+	}
+
+	w := get("/jobs/"+id, "admin")
+	var j job
+	if w.Code != 200 || json.NewDecoder(w.Body).Decode(&j) != nil || j.Status != jobSucceeded || j.App != "myapp" {
+		t.Fatalf("GET /jobs/%s: status %d, %+v", id, w.Code, j)
+	}
+	if j.Steps[0].Detail != "token "+redactedPlaceholder {
+		t.Errorf("step detail not redacted: %q", j.Steps[0].Detail)
+	}
+
+	w = get("/jobs", "admin")
+	var list []job
+	if w.Code != 200 || json.NewDecoder(w.Body).Decode(&list) != nil || len(list) == 0 || list[0].ID != id {
+		t.Errorf("GET /jobs: status %d, %d jobs", w.Code, len(list))
+	}
+
+	// An app's admin key sees that app's jobs, but not the list
+	adminKey := createAPIKey(t, []string{"myapp"}, []string{actionAdmin})
+	deployKey := createAPIKey(t, []string{"myapp"}, []string{actionDeploy})
+	otherKey := createAPIKey(t, []string{"other"}, []string{actionAdmin})
+	for _, tt := range []struct {
+		target, key string
+		want        int
+	}{
+		{"/jobs/" + id, adminKey, 200},
+		{"/jobs/" + id, deployKey, 401},
+		{"/jobs/" + id, otherKey, 401},
+		{"/jobs/" + id, "", 401},
+		{"/jobs", adminKey, 401},
+		{"/jobs/missing", "admin", 404},
+	} {
+		if w := get(tt.target, tt.key); w.Code != tt.want {
+			t.Errorf("GET %s: status %d, want %d", tt.target, w.Code, tt.want)
+		}
+	}
+}
+
+func TestJobStoreHistoryLimit(t *testing.T) {
+	var first string
+	for i := 0; i < jobHistoryLimit+5; i++ {
+		id := jobs.create("test", "myapp")
+		if i == 0 {
+			first = id
+		}
+	}
+	if _, ok := jobs.get(first); ok {
+		t.Error("oldest job kept past the history limit")
+	}
+	if n := len(jobs.list()); n != jobHistoryLimit {
+		t.Errorf("%d jobs kept, want %d", n, jobHistoryLimit)
+	}
+}
+
+func TestTeardownApp(t *testing.T) {
+	useAdminAuth(t, "", false)
+	config := setupWebhookTest(t)
+	useSecretsKey(t, "root-key-one")
+	useAppsDir(t)
+	commandLog := useFakeCommands(t)
+
+	plain := t.TempDir() // Not a git checkout, and no compose file
+	os.Mkdir(filepath.Join(config.Path, ".git"), 0755)
+	os.WriteFile(filepath.Join(config.Path, "docker-compose.yml"), nil, 0600)
+	registryLock.Lock()
+	delete(registry, "myapp") // Other tests leave myapp's deploy lock held
+	registry["doomed"] = config
+	registry["plain"] = AppConfig{Path: plain, Branch: "main", Secret: "plain-secret"}
+	registry["busy"] = AppConfig{Path: t.TempDir(), Branch: "main", Secret: "busy-secret"}
+	registryLock.Unlock()
+	path := writeTestRegistry(t, "{}")
+	useRegistryPath(t, path)
+
+	if err := appEnv.set("doomed", map[string]string{"API_KEY": "value"}); err != nil {
+		t.Fatal(err)
+	}
+	webhookCaptures.capture("doomed", http.Header{}, []byte(`{}`), "192.0.2.1:1234", time.Now())
+	deliveries.record(&webhookDelivery{ID: "d1", App: "doomed", ReceivedAt: time.Now(), Outcome: "deployed"})
+	deliveries.record(&webhookDelivery{ID: "d2", App: "plain", ReceivedAt: time.Now(), Outcome: "deployed"})
+
+	teardown := func(target string) job {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handleApps(w, adminRequest("DELETE", target, nil))
+		var accepted struct{ Job string }
+		if w.Code != 202 || json.NewDecoder(w.Body).Decode(&accepted) != nil {
+			t.Fatalf("DELETE %s: status %d, body %q", target, w.Code, w.Body.String())
+		}
+		return waitForJob(t, accepted.Job)
+	}
+
+	j := teardown("/apps/doomed?purge=true&volumes=true")
+	if j.Status != jobSucceeded || stepStatuses(j) != "down:succeeded unregister:succeeded webhook:skipped checkout:succeeded state:succeeded" {
+		t.Fatalf("job = %s, %s (%s)", j.Status, stepStatuses(j), j.Error)
+	}
+	if commands := fakeCommandLog(t, commandLog); !strings.Contains(commands, "down --remove-orphans --volumes") {
+		t.Errorf("containers not removed:\n%s", commands)
+	}
+	registryLock.RLock()
+	_, exists := registry["doomed"]
+	registryLock.RUnlock()
+	if data, _ := os.ReadFile(path); exists || strings.Contains(string(data), "doomed") {
+		t.Errorf("app still registered: %s", data)
+	}
+	if _, err := os.Stat(config.Path); !os.IsNotExist(err) {
+		t.Errorf("checkout not deleted: %v", err)
+	}
+	if names, _ := appEnv.names("doomed"); len(names) != 0 {
+		t.Errorf("managed env left behind: %v", names)
+	}
+	if captures := webhookCaptures.list("doomed"); len(captures) != 0 {
+		t.Errorf("%d captured webhooks left behind", len(captures))
+	}
+	if len(deliveries.list("doomed", 0)) != 0 || len(deliveries.list("plain", 0)) != 1 {
+		t.Errorf("deliveries = %+v", deliveries.list("", 0))
+	}
+
+	// Directories that aren't git checkouts are left in place
+	j = teardown("/apps/plain?purge=true")
+	if j.Status != jobSucceeded || stepStatuses(j) != "down:skipped unregister:succeeded webhook:skipped checkout:skipped state:succeeded" {
+		t.Errorf("job = %s, %s", j.Status, stepStatuses(j))
+	}
+	if _, err := os.Stat(plain); err != nil {
+		t.Errorf("non-checkout directory removed: %v", err)
+	}
+
+	// A second teardown finds nothing, and one during a deploy is refused
+	w := httptest.NewRecorder()
+	handleApps(w, adminRequest("DELETE", "/apps/plain?purge=true", nil))
+	if w.Code != 404 {
+		t.Errorf("tearing down twice: status %d", w.Code)
+	}
+	holdDeployLock("busy")
+	w = httptest.NewRecorder()
+	handleApps(w, adminRequest("DELETE", "/apps/busy?purge=true", nil))
+	if w.Code != 409 {
+		t.Errorf("teardown during a deploy: status %d", w.Code)
+	}
+}
+
+func TestTeardownAppStopsOnFailure(t *testing.T) {
+	useAdminAuth(t, "", false)
+	config := setupWebhookTest(t)
+	useAppsDir(t)
+	useFakeCommands(t)
+	os.Mkdir(filepath.Join(config.Path, ".git"), 0755)
+	os.WriteFile(filepath.Join(config.Path, "docker-compose.yml"), nil, 0600)
+	registryLock.Lock()
+	delete(registry, "myapp") // Other tests leave myapp's deploy lock held
+	registry["stuck"] = config
+	registryLock.Unlock()
+	useRegistryPath(t, writeTestRegistry(t, "{}"))
+
+	// If the containers can't be removed, the app stays registered and its checkout stays
+	t.Setenv("FAKE_FAIL", "down")
+	w := httptest.NewRecorder()
+	handleApps(w, adminRequest("DELETE", "/apps/stuck?purge=true", nil))
+	var accepted struct{ Job string }
+	if w.Code != 202 || json.NewDecoder(w.Body).Decode(&accepted) != nil {
+		t.Fatalf("DELETE: status %d", w.Code)
+	}
+	j := waitForJob(t, accepted.Job)
+	if j.Status != jobFailed || stepStatuses(j) != "down:failed unregister:pending webhook:pending checkout:pending state:pending" {
+		t.Errorf("job = %s, %s", j.Status, stepStatuses(j))
+	}
+	registryLock.RLock()
+	_, exists := registry["stuck"]
+	registryLock.RUnlock()
+	if _, err := os.Stat(config.Path); !exists || err != nil {
+		t.Errorf("registered %v, checkout %v", exists, err)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCA writes a self-signed CA certificate as PEM and returns its path
+func writeTestCA(t *testing.T) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test ACME CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestNewACMEManager(t *testing.T) {
+	cacheDir := filepath.Join(t.TempDir(), "acme")
+	manager, err := newACMEManager(" deploy.example.com, ,hooks.example.com", "ops@example.com", "https://acme.test/dir", writeTestCA(t), cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for _, host := range []string{"deploy.example.com", "hooks.example.com"} {
+		if err := manager.HostPolicy(ctx, host); err != nil {
+			t.Errorf("host %s rejected: %v", host, err)
+		}
+	}
+	if err := manager.HostPolicy(ctx, "other.example.com"); err == nil {
+		t.Error("certificate allowed for a domain that wasn't configured")
+	}
+	if manager.Email != "ops@example.com" || manager.Client.DirectoryURL != "https://acme.test/dir" {
+		t.Errorf("email %q, directory %q", manager.Email, manager.Client.DirectoryURL)
+	}
+	if manager.Client.HTTPClient == nil {
+		t.Error("extra CA roots not used for the ACME directory")
+	}
+	if info, err := os.Stat(cacheDir); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("cache dir: %v, %v", info, err)
+	}
+
+	// TLS-ALPN-01 challenges are answered on the TLS port
+	hasALPN := false
+	for _, proto := range manager.TLSConfig().NextProtos {
+		hasALPN = hasALPN || proto == "acme-tls/1"
+	}
+	if !hasALPN {
+		t.Error("TLS config doesn't offer acme-tls/1")
+	}
+
+	// The HTTP port redirects everything but challenges to HTTPS
+	w := httptest.NewRecorder()
+	manager.HTTPHandler(nil).ServeHTTP(w, httptest.NewRequest("GET", "http://deploy.example.com/webhook/github", nil))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "https://deploy.example.com/webhook/github" {
+		t.Errorf("HTTP request: status %d, location %q", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestNewACMEManagerErrors(t *testing.T) {
+	notPEM := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, domains, caCertFile string
+	}{
+		{"no domains", " , ", ""},
+		{"missing CA file", "deploy.example.com", filepath.Join(t.TempDir(), "missing.pem")},
+		{"CA file without certificates", "deploy.example.com", notPEM},
+	}
+	for _, tt := range tests {
+		if _, err := newACMEManager(tt.domains, "", "https://acme.test/dir", tt.caCertFile, t.TempDir()); err == nil {
+			t.Errorf("%s: newACMEManager succeeded", tt.name)
+		}
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupWebhookTest registers an app named myapp watching main and restores the globals afterwards
+func setupWebhookTest(t *testing.T) AppConfig {
+	t.Helper()
+	config := AppConfig{Path: t.TempDir(), Branch: "main", Secret: "test-secret"}
+
+	savedRegistry, savedDeliveries, savedCaptures := registry, deliveries, webhookCaptures
+	t.Cleanup(func() {
+		registryLock.Lock()
+		registry = savedRegistry
+		registryLock.Unlock()
+		deliveries, webhookCaptures = savedDeliveries, savedCaptures
+	})
+
+	registryLock.Lock()
+	registry = map[string]AppConfig{"myapp": config}
+	registryLock.Unlock()
+	deliveries = loadDeliveryLog(filepath.Join(t.TempDir(), "deliveries.json"))
+	webhookCaptures = newWebhookCaptureStore(t.TempDir(), 5)
+	return config
+}
+
+// testSignature signs a payload the way GitHub does
+func testSignature(body, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// githubRequest builds a signed push webhook delivery
+func githubRequest(body, deliveryID, secret string) *http.Request {
+	r := httptest.NewRequest("POST", "/webhook/github", strings.NewReader(body))
+	r.Header.Set("X-GitHub-Event", "push")
+	r.Header.Set("X-Hub-Signature-256", testSignature(body, secret))
+	if deliveryID != "" {
+		r.Header.Set("X-GitHub-Delivery", deliveryID)
+	}
+	return r
+}
+
+func TestValidateSignature(t *testing.T) {
+	payload := []byte(`{"ref":"refs/heads/main"}`)
+	valid := signPayload(payload, "s3cr3t")
+
+	tests := []struct {
+		name, secret, header string
+		want                 bool
+	}{
+		{"valid", "s3cr3t", valid, true},
+		{"wrong secret", "other", valid, false},
+		{"missing prefix", "s3cr3t", valid[len("sha256="):], false},
+		{"sha1 header", "s3cr3t", "sha1=" + valid[len("sha256="):], false},
+		{"empty", "s3cr3t", "", false},
+		{"truncated", "s3cr3t", valid[:len(valid)-1], false},
+	}
+	for _, tt := range tests {
+		if got := validateSignature(payload, tt.secret, tt.header); got != tt.want {
+			t.Errorf("%s: validateSignature = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if validateSignature([]byte(`{"ref":"refs/heads/evil"}`), "s3cr3t", valid) {
+		t.Error("signature accepted for a different payload")
+	}
+}
+
+func TestValidateAppSignatureRotation(t *testing.T) {
+	payload := []byte(`{}`)
+	future := time.Now().Add(time.Hour)
+	past := time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		name   string
+		config AppConfig
+		signer string
+		want   bool
+	}{
+		{"current secret", AppConfig{Secret: "new"}, "new", true},
+		{"no previous secret", AppConfig{Secret: "new"}, "old", false},
+		{"previous secret in grace period", AppConfig{Secret: "new", PreviousSecret: "old", PreviousSecretExpires: &future}, "old", true},
+		{"current secret during rotation", AppConfig{Secret: "new", PreviousSecret: "old", PreviousSecretExpires: &future}, "new", true},
+		{"previous secret expired", AppConfig{Secret: "new", PreviousSecret: "old", PreviousSecretExpires: &past}, "old", false},
+		{"previous secret without expiry", AppConfig{Secret: "new", PreviousSecret: "old"}, "old", false},
+		{"unrelated secret during rotation", AppConfig{Secret: "new", PreviousSecret: "old", PreviousSecretExpires: &future}, "other", false},
+	}
+	for _, tt := range tests {
+		if got := validateAppSignature(tt.config, payload, signPayload(payload, tt.signer)); got != tt.want {
+			t.Errorf("%s: validateAppSignature = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDeliveryLogReplay(t *testing.T) {
+	dl := loadDeliveryLog(filepath.Join(t.TempDir(), "deliveries.json"))
+	body := []byte(`{"n":1}`)
+
+	// Checking doesn't mark, so rejected deliveries can be redelivered
+	if dl.seen("d1", body) || dl.seen("d1", body) {
+		t.Fatal("unaccepted delivery reported as seen")
+	}
+	if !dl.accept("d1", body) {
+		t.Fatal("first accept failed")
+	}
+	if !dl.seen("d1", body) || dl.accept("d1", body) {
+		t.Error("accepted delivery not treated as a duplicate")
+	}
+	if dl.accept("d2", body) {
+		t.Error("same payload under a new delivery ID accepted")
+	}
+	if dl.accept("d1", []byte(`{"n":2}`)) {
+		t.Error("same delivery ID with a new payload accepted")
+	}
+	if !dl.accept("d3", []byte(`{"n":3}`)) {
+		t.Error("new delivery rejected")
+	}
+
+	// Seen entries survive a restart
+	reloaded := loadDeliveryLog(dl.path)
+	if !reloaded.seen("d1", body) {
+		t.Error("accepted delivery forgotten after reload")
+	}
+}
+
+func TestHandleGithubReplay(t *testing.T) {
+	config := setupWebhookTest(t)
+	push := `{"ref":"refs/heads/other","repository":{"name":"myapp"}}`
+
+	post := func(r *http.Request) int {
+		w := httptest.NewRecorder()
+		handleGithub(w, r)
+		return w.Code
+	}
+
+	// Nothing was dispatched, so the same delivery may arrive again
+	for i := 0; i < 2; i++ {
+		if code := post(githubRequest(push, "d1", config.Secret)); code != 200 {
+			t.Fatalf("ignored push %d: status %d, want 200", i+1, code)
+		}
+	}
+	if code := post(githubRequest(push, "", config.Secret)); code != 400 {
+		t.Errorf("missing delivery ID: status %d, want 400", code)
+	}
+	if code := post(githubRequest(push, "d2", "wrong-secret")); code != 403 {
+		t.Errorf("bad signature: status %d, want 403", code)
+	}
+	if deliveries.seen("d2", []byte(push)) {
+		t.Error("forged delivery marked as seen")
+	}
+
+	// Once dispatched, the ID and the payload are both rejected
+	deliveries.accept("d1", []byte(push))
+	if code := post(githubRequest(push, "d1", config.Secret)); code != 409 {
+		t.Errorf("replayed delivery: status %d, want 409", code)
+	}
+	if code := post(githubRequest(push, "d3", config.Secret)); code != 409 {
+		t.Errorf("replayed payload under a new ID: status %d, want 409", code)
+	}
+
+	history := deliveries.list("myapp", 0)
+	if len(history) == 0 || history[0].Outcome != "duplicate" {
+		t.Errorf("latest delivery = %+v, want a duplicate", history)
+	}
+}
+
+func TestWebhookCaptures(t *testing.T) {
+	config := setupWebhookTest(t)
+	useAdminAuth(t, "", false)
+	// The payload mentions the secret, which must never be served back
+	push := `{"ref":"refs/heads/other","repository":{"name":"myapp"},"note":"test-secret"}`
+
+	captures := func(method, query string) *httptest.ResponseRecorder {
+		r := adminRequest(method, "/webhooks?app=myapp"+query, nil)
+		w := httptest.NewRecorder()
+		handleWebhookCaptures(w, r)
+		return w
+	}
+
+	handleGithub(httptest.NewRecorder(), githubRequest(push, "forged", "wrong-secret"))
+	signed := githubRequest(push, "d1", config.Secret)
+	signed.Header.Set("X-Forwarded-Auth", "token ghp_"+strings.Repeat("a", 36))
+	handleGithub(httptest.NewRecorder(), signed)
+
+	var list []capturedWebhook
+	if err := json.Unmarshal(captures("GET", "").Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].DeliveryID != "d1" || list[0].Body != "" || list[0].Headers != nil {
+		t.Fatalf("captures = %+v, want a summary of the signed delivery only", list)
+	}
+	id := list[0].ID
+
+	var capture capturedWebhook
+	if err := json.Unmarshal(captures("GET", "&id="+id).Body.Bytes(), &capture); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(capture.Body, config.Secret) || !strings.Contains(capture.Body, `"note":"[REDACTED]"`) {
+		t.Errorf("served body %q still holds the secret", capture.Body)
+	}
+	if got := http.Header(capture.Headers).Get("X-Hub-Signature-256"); got != "[REDACTED]" {
+		t.Errorf("signature header served as %q", got)
+	}
+	if got := http.Header(capture.Headers).Get("X-Forwarded-Auth"); got != "token [REDACTED]" {
+		t.Errorf("token in a header served as %q", got)
+	}
+
+	// Redelivery replays the original bytes
+	if stored, _ := webhookCaptures.get("myapp", id); stored.Body != push || strings.Contains(http.Header(stored.Headers).Get("X-Forwarded-Auth"), "[REDACTED]") {
+		t.Errorf("stored capture = %+v, want the original request", stored)
+	}
+	w := captures("POST", "&id="+id)
+	if w.Code != 200 || w.Body.String() != "Ignored branch" {
+		t.Fatalf("redelivery: status %d: %s", w.Code, w.Body.String())
+	}
+	if latest := deliveries.list("myapp", 1); latest[0].Detail != "redelivery of "+id+"; watching main" {
+		t.Errorf("redelivery recorded as %+v", latest[0])
+	}
+	if code := captures("POST", "&id=missing").Code; code != 404 {
+		t.Errorf("unknown capture: status %d, want 404", code)
+	}
+
+	r := httptest.NewRequest("GET", "/webhooks?app=myapp", nil)
+	w = httptest.NewRecorder()
+	handleWebhookCaptures(w, r)
+	if w.Code != 401 {
+		t.Errorf("unauthenticated: status %d, want 401", w.Code)
+	}
+}
+
+func TestWebhookCapturesEncrypted(t *testing.T) {
+	config := setupWebhookTest(t)
+	useAdminAuth(t, "", false)
+	useSecretsKey(t, "root-key-one")
+	push := `{"ref":"refs/heads/other","repository":{"name":"myapp"}}`
+	handleGithub(httptest.NewRecorder(), githubRequest(push, "d1", config.Secret))
+
+	id := webhookCaptures.list("myapp")[0].ID
+	stored, _ := webhookCaptures.get("myapp", id)
+	if !isEncryptedSecret(stored.Body) || strings.Contains(stored.Body, "refs/heads") {
+		t.Fatalf("stored body = %q, want it encrypted", stored.Body)
+	}
+
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handleWebhookCaptures(w, adminRequest("GET", "/webhooks?app=myapp&id="+id, nil))
+		return w
+	}
+	var capture capturedWebhook
+	if err := json.Unmarshal(get().Body.Bytes(), &capture); err != nil || capture.Body != push {
+		t.Errorf("served body = %q, %v; want the decrypted payload", capture.Body, err)
+	}
+
+	w := httptest.NewRecorder()
+	handleWebhookCaptures(w, adminRequest("POST", "/webhooks?app=myapp&id="+id, nil))
+	if w.Code != 200 || w.Body.String() != "Ignored branch" {
+		t.Errorf("redelivery: status %d: %s", w.Code, w.Body.String())
+	}
+
+	useSecretsKey(t, "root-key-two")
+	if w := get(); w.Code != 500 || strings.Contains(w.Body.String(), "refs/heads") {
+		t.Errorf("wrong root key: status %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRestoreRotatedSecret(t *testing.T) {
+	savedRegistry, savedPath := registry, registryPath
+	t.Cleanup(func() {
+		registryLock.Lock()
+		registry, registryPath = savedRegistry, savedPath
+		registryLock.Unlock()
+		redactor.set("app:myapp", nil, 0)
+	})
+	registryPath = filepath.Join(t.TempDir(), "registry.json")
+
+	previous := AppConfig{Path: "/srv/myapp", Branch: "main", Secret: "old-secret"}
+	expires := time.Now().Add(time.Hour)
+	rotated := previous
+	rotated.Secret, rotated.PreviousSecret, rotated.PreviousSecretExpires = "new-secret", "old-secret", &expires
+
+	registryLock.Lock()
+	registry = map[string]AppConfig{"myapp": rotated}
+	registryLock.Unlock()
+	if !restoreRotatedSecret("myapp", "new-secret", previous) {
+		t.Fatal("rotation not rolled back")
+	}
+	if got := registry["myapp"]; got.Secret != "old-secret" || got.PreviousSecret != "" {
+		t.Errorf("after rollback config = %+v", got)
+	}
+
+	// A concurrent change (e.g. another rotation) is never overwritten
+	changed := rotated
+	changed.Secret = "newer-secret"
+	registryLock.Lock()
+	registry = map[string]AppConfig{"myapp": changed}
+	registryLock.Unlock()
+	if restoreRotatedSecret("myapp", "new-secret", previous) || registry["myapp"].Secret != "newer-secret" {
+		t.Error("rolled back over a newer secret")
+	}
+	if restoreRotatedSecret("gone", "new-secret", previous) {
+		t.Error("rolled back a removed app")
+	}
+}
+
+func TestHandleRotateSecret(t *testing.T) {
+	config := setupWebhookTest(t)
+	auditPath := useAuditLog(t, false)
+	savedPath, savedApp := registryPath, githubAppConfig
+	t.Cleanup(func() {
+		registryPath = savedPath
+		githubAppLock.Lock()
+		githubAppConfig = savedApp
+		githubAppLock.Unlock()
+		redactor.set("app:myapp", nil, 0)
+	})
+	registryPath = filepath.Join(t.TempDir(), "registry.json")
+	githubAppLock.Lock()
+	githubAppConfig = nil
+	githubAppLock.Unlock()
+
+	rotate := func(body io.Reader) *httptest.ResponseRecorder {
+		r := adminRequest("POST", "/github/rotate-secret?app=myapp", body)
+		w := httptest.NewRecorder()
+		handleRotateSecret(w, r)
+		return w
+	}
+
+	for body, want := range map[string]int{`{`: 400, `{"grace_period":"soon"}`: 400} {
+		if w := rotate(strings.NewReader(body)); w.Code != want {
+			t.Errorf("body %s: status %d, want %d", body, w.Code, want)
+		}
+	}
+
+	// An empty chunked body means default options; without the GitHub App the secret is only
+	// rotated locally
+	w := rotate(struct{ io.Reader }{strings.NewReader("")})
+	if w.Code != 200 {
+		t.Fatalf("rotate: status %d: %s", w.Code, w.Body.String())
+	}
+	var result struct {
+		Secret      string `json:"secret"`
+		GitHubError string `json:"github_error"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if result.Secret == "" || result.Secret == config.Secret || result.GitHubError == "" {
+		t.Fatalf("rotate result = %s", w.Body.String())
+	}
+	if data, err := os.ReadFile(registryPath); err != nil || !strings.Contains(string(data), result.Secret) {
+		t.Errorf("rotated secret not saved: %s, %v", data, err)
+	}
+
+	// Both secrets are accepted during the grace period
+	push := `{"ref":"refs/heads/other","repository":{"name":"myapp"}}`
+	for i, secret := range []string{config.Secret, result.Secret} {
+		w := httptest.NewRecorder()
+		handleGithub(w, githubRequest(push, fmt.Sprintf("rot-%d", i), secret))
+		if w.Code != 200 {
+			t.Errorf("delivery signed with secret %d: status %d", i, w.Code)
+		}
+	}
+
+	// When GitHub can't be updated, the rotation is undone
+	githubAppLock.Lock()
+	githubAppConfig = &GitHubAppConfig{AppID: "1", InstallationID: "2", PrivateKey: "not a key"}
+	githubAppLock.Unlock()
+	if w := rotate(strings.NewReader(`{"repo":"org/myapp"}`)); w.Code != 502 {
+		t.Fatalf("rotate with GitHub failing: status %d: %s", w.Code, w.Body.String())
+	}
+	registryLock.RLock()
+	current := registry["myapp"]
+	registryLock.RUnlock()
+	if current.Secret != result.Secret {
+		t.Errorf("secret after a failed rotation = %q, want %q", current.Secret, result.Secret)
+	}
+
+	entries := readAuditLog(t, auditPath)
+	if last := entries[len(entries)-1]; last.Action != "secret.rotate" || last.Outcome != "failure" || last.Details["rolled_back"] != true {
+		t.Errorf("last audit entry = %+v", last)
+	}
+}